@@ -0,0 +1,122 @@
+package labrpc
+
+//
+// calls that don't block the caller, and streams of them.
+//
+// c := end.Go("Raft.AppendEntries", &args, &reply, done) -- start the
+//   call, and return. when it completes, c.Error says how (as the error
+//   from CallContext()), and c is sent on done. done may be shared by
+//   many calls, so that one goroutine can wait for them all; it must be
+//   buffered, and the calls wait for room on it. if done is nil, Go()
+//   makes a channel for just this call, c.Done.
+// end.GoContext(ctx, ...) -- the same, giving up when ctx is done.
+//
+// st := end.OpenStream(ctx, "Raft.InstallSnapshot", window) -- a stream
+//   of calls to one method, e.g. the chunks of a large transfer, with at
+//   most window of them in flight at a time.
+// st.Send(&args, &reply) -- start the next call, after waiting until
+//   fewer than window are in flight; reply is filled in once Close()
+//   returns. if a call has failed, Send() returns its error instead, and
+//   the stream sends nothing more.
+// st.Close() -- wait for the calls in flight, and return the first error.
+//
+// the calls of a stream may reach the server in any order, as any
+// concurrent calls may, so each should say where its part goes (e.g.
+// with an offset); a window of 1 keeps them in order. a Stream is for
+// one goroutine to use.
+//
+// in a simulation (see MakeSimNetwork()), wait on done with labsim.Recv().
+//
+
+import (
+	"context"
+	"lab4/labsim"
+)
+
+// AsyncCall is a call started by Go().
+type AsyncCall struct {
+	SvcMeth string
+	Args    interface{}
+	Reply   interface{}
+	Error   error           // once complete; nil if Reply is valid
+	Done    chan *AsyncCall // receives the call when it completes
+}
+
+func (e *ClientEnd) Go(svcMeth string, args interface{}, reply interface{}, done chan *AsyncCall) *AsyncCall {
+	return e.GoContext(context.Background(), svcMeth, args, reply, done)
+}
+
+func (e *ClientEnd) GoContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}, done chan *AsyncCall) *AsyncCall {
+	if done == nil {
+		done = make(chan *AsyncCall, 1)
+	} else if cap(done) == 0 {
+		panic("labrpc: ClientEnd.Go(): done channel is unbuffered")
+	}
+	c := &AsyncCall{SvcMeth: svcMeth, Args: args, Reply: reply, Done: done}
+	s := e.sim()
+	s.Go(func() {
+		c.Error = e.CallContext(ctx, svcMeth, args, reply)
+		labsim.Send(s, c.Done, c)
+	})
+	return c
+}
+
+// the simulation e's Network runs in, if any.
+func (e *ClientEnd) sim() *labsim.Sim {
+	if e.net == nil {
+		return nil
+	}
+	return e.net.sim
+}
+
+// Stream is a stream of calls opened by OpenStream().
+type Stream struct {
+	e        *ClientEnd
+	ctx      context.Context
+	svcMeth  string
+	window   int
+	done     chan *AsyncCall
+	inflight int
+	err      error // of the first call that failed
+}
+
+func (e *ClientEnd) OpenStream(ctx context.Context, svcMeth string, window int) *Stream {
+	if window < 1 {
+		window = 1
+	}
+	return &Stream{
+		e:       e,
+		ctx:     ctx,
+		svcMeth: svcMeth,
+		window:  window,
+		done:    make(chan *AsyncCall, window),
+	}
+}
+
+func (st *Stream) Send(args interface{}, reply interface{}) error {
+	for st.err == nil && st.inflight >= st.window {
+		st.wait()
+	}
+	if st.err != nil {
+		return st.err
+	}
+	st.inflight++
+	st.e.GoContext(st.ctx, st.svcMeth, args, reply, st.done)
+	return nil
+}
+
+func (st *Stream) Close() error {
+	for st.inflight > 0 {
+		st.wait()
+	}
+	return st.err
+}
+
+// wait for a call in flight to complete.
+func (st *Stream) wait() {
+	c, _ := labsim.Recv(st.e.sim(), st.done)
+	st.inflight--
+	if c.Error != nil && st.err == nil {
+		st.err = c.Error
+	}
+}
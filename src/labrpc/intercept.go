@@ -0,0 +1,101 @@
+package labrpc
+
+//
+// interceptors, to wrap RPCs in tracing, metrics, checks or faults,
+// for all methods or for chosen ones, without changing the code that
+// makes or handles them.
+//
+// end.Intercept(ci, ...) -- the calls made on end go through ci, and then
+//   through the next ones, before they are sent.
+// srv.Intercept(si, ...) -- the requests srv receives go through si, and
+//   then through the next ones, before the handler runs.
+//
+// an interceptor sees the service method (e.g. "Raft.AppendEntries"), the
+// args, and the reply, decoded: on the client the caller's own, on the
+// server the ones the handler gets. it goes on by calling the next step
+// it is given, perhaps with other args or a reply of its own; or it
+// doesn't, and returns an error. a ClientInterceptor's error is what
+// CallContext() returns, and Call() returns false for it. a
+// ServerInterceptor's error fails the call with a *RejectedError, on a
+// Network and over TCP alike.
+//
+// e.g. to lose a third of the AppendEntries a server gets:
+//
+//	srv.Intercept(func(from interface{}, svcMeth string, args, reply interface{}, handle Handler) error {
+//		if svcMeth == "Raft.AppendEntries" && rand.Intn(3) == 0 {
+//			return errors.New("dropped")
+//		}
+//		return handle(args, reply)
+//	})
+//
+
+import (
+	"context"
+	"errors"
+)
+
+// Invoker makes a call, or passes it on to the next ClientInterceptor.
+type Invoker func(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error
+
+type ClientInterceptor func(ctx context.Context, svcMeth string, args interface{}, reply interface{}, invoke Invoker) error
+
+// Handler runs the handler, or passes the call on to the next
+// ServerInterceptor.
+type Handler func(args interface{}, reply interface{}) error
+
+// from is the name of the calling ClientEnd; over TCP, its address.
+type ServerInterceptor func(from interface{}, svcMeth string, args interface{}, reply interface{}, handle Handler) error
+
+var ErrRejected = errors.New("labrpc: the server rejected the call")
+
+// RejectedError is the error of a call that a ServerInterceptor failed;
+// errors.Is(err, ErrRejected) holds for it.
+type RejectedError struct {
+	Why string // the interceptor's error
+}
+
+func (e *RejectedError) Error() string {
+	return ErrRejected.Error() + ": " + e.Why
+}
+
+func (e *RejectedError) Is(target error) bool {
+	return target == ErrRejected
+}
+
+// add interceptors for the calls made on e, after those it has; the
+// first one added sees a call first.
+func (e *ClientEnd) Intercept(interceptors ...ClientInterceptor) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.interceptors = append(e.interceptors[:len(e.interceptors):len(e.interceptors)], interceptors...)
+}
+
+// add interceptors for the requests rs gets, after those it has; the
+// first one added sees a request first.
+func (rs *Server) Intercept(interceptors ...ServerInterceptor) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.interceptors = append(rs.interceptors[:len(rs.interceptors):len(rs.interceptors)], interceptors...)
+}
+
+// wrap invoke in interceptors, the first one outermost.
+func chainClient(interceptors []ClientInterceptor, invoke Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		ci, next := interceptors[i], invoke
+		invoke = func(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+			return ci(ctx, svcMeth, args, reply, next)
+		}
+	}
+	return invoke
+}
+
+// wrap handle in interceptors, the first one outermost.
+func chainServer(interceptors []ServerInterceptor, from interface{}, svcMeth string, handle Handler) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		si, next := interceptors[i], handle
+		handle = func(args interface{}, reply interface{}) error {
+			return si(from, svcMeth, args, reply, next)
+		}
+	}
+	return handle
+}
@@ -16,12 +16,37 @@ package labrpc
 // don't include references to program objects.
 //
 // net := MakeNetwork() -- holds network, clients, servers.
+// net := MakeSimNetwork(sim) -- the same, run in a labsim simulation: its
+//   delays, losses and timers are on sim's virtual clock, and drawn from
+//   sim's seed. the callers and the handlers have to follow labsim's rules.
 // end := net.MakeEnd(endname) -- create a client end-point, to talk to one server.
 // net.AddServer(servername, server) -- adds a named server to network.
 // net.DeleteServer(servername) -- eliminate the named server.
 // net.Connect(endname, servername) -- connect a client to a server.
 // net.Enable(endname, enabled) -- enable/disable a client.
 // net.Reliable(bool) -- false means drop/delay messages
+// net.SetHost(endname, servername) -- the end is on the named server's
+//   host, so partitions apply to it.
+// net.Partition(groups ...) -- split the servers into groups; servers
+//   can only reach the others in a group they share.
+// net.CutLink(from, to) -- lose the messages from one server to another,
+//   but not the other way around.
+// net.Heal() -- undo Partition() and CutLink().
+// net.Duplicate(rate) -- deliver that fraction of requests to the server
+//   a second time, a while later.
+// net.StaleReplies(rate) -- for that fraction of the duplicated requests,
+//   the caller gets the reply to the late copy.
+// net.SetLinkPolicy(from, to, policy) -- the latency, loss, duplication
+//   and bandwidth of the link from ends on server from to server to,
+//   see link.go.
+// net.StartRecording(w) -- write a Record of every request to w, to be
+//   replayed into a Server, see record.go.
+// net.Stats(), srv.Stats() -- counts, bytes and latencies by service
+//   method and by link, see stats.go.
+// end.Intercept(ci, ...), srv.Intercept(si, ...) -- wrap the calls on
+//   end, or the requests srv gets, in interceptors, see intercept.go.
+// end.Go(...), end.OpenStream(...) -- calls that don't wait for the
+//   reply, and windowed streams of them, see async.go.
 //
 // end.Call("Raft.AppendEntries", &args, &reply) -- send an RPC, wait for reply.
 // the "Raft" is the name of the server struct to be called.
@@ -36,6 +61,12 @@ package labrpc
 // since the network may re-order messages.
 // Call() is guaranteed to return (perhaps after a delay) *except* if the
 // handler function on the server side does not return.
+//
+// end.CallContext(ctx, "Raft.AppendEntries", &args, &reply) -- like Call(),
+// but gives up when ctx is done, and returns an error that says why the
+// call failed (nil if it succeeded): ctx.Err(), ErrTimeout, ErrUnreachable,
+// ErrServerDead, ErrDecode, or a *DispatchError if the server has no such
+// method, or can't decode the args.
 // the server RPC handler function must declare its args and reply arguments
 // as pointers, so that their types exactly match the types of the arguments
 // to Call().
@@ -48,13 +79,20 @@ package labrpc
 //   much like Go's rpcs.Register()
 //   pass svc to srv.AddService()
 //
+// tcp.go has a transport that carries the same RPCs between processes:
+// MakeTCPEnd() instead of net.MakeEnd(), and srv.Serve(listener).
+//
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"lab4/labgob"
+	"lab4/labsim"
 	"log"
-	"math/rand"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -62,33 +100,119 @@ import (
 )
 
 type reqMsg struct {
-	endname  interface{} // name of sending ClientEnd
-	svcMeth  string      // e.g. "Raft.AppendEntries"
-	argsType reflect.Type
+	endname  interface{}  // name of sending ClientEnd
+	svcMeth  string       // e.g. "Raft.AppendEntries"
+	argsType reflect.Type // nil if it came over TCP
 	args     []byte
 	replyCh  chan replyMsg
+	rec      *Record   // nil unless the Network is recording
+	sent     time.Time // when the Network accepted it
 }
 
 type replyMsg struct {
 	ok    bool
 	reply []byte
+	err   error // why not ok
+}
+
+var (
+	ErrTimeout     = errors.New("labrpc: the request or reply was lost, or the call timed out")
+	ErrUnreachable = errors.New("labrpc: can't reach the server")
+	ErrServerDead  = errors.New("labrpc: the server died before replying")
+	ErrDecode      = errors.New("labrpc: can't decode the reply")
+
+	ErrUnknownService = errors.New("labrpc: the server has no such service")
+	ErrUnknownMethod  = errors.New("labrpc: the service has no such method")
+	ErrBadArgs        = errors.New("labrpc: the server can't decode the args")
+)
+
+// DispatchError is the error of a call that reached the server, but that
+// the server couldn't hand to a handler, e.g. because it runs an older
+// version that lacks the method. errors.Is(err, ErrX) holds for the
+// ErrX it says.
+type DispatchError struct {
+	Failure DispatchFailure
+	SvcMeth string
+	Detail  string // what the server has instead, or why it can't decode
+}
+
+type DispatchFailure int
+
+const (
+	UnknownService DispatchFailure = iota + 1 // ErrUnknownService
+	UnknownMethod                             // ErrUnknownMethod
+	BadArgs                                   // ErrBadArgs
+)
+
+func (f DispatchFailure) err() error {
+	switch f {
+	case UnknownService:
+		return ErrUnknownService
+	case UnknownMethod:
+		return ErrUnknownMethod
+	case BadArgs:
+		return ErrBadArgs
+	}
+	return nil
+}
+
+func (e *DispatchError) Error() string {
+	return fmt.Sprintf("%v: %v: %v", e.Failure.err(), e.SvcMeth, e.Detail)
+}
+
+func (e *DispatchError) Is(target error) bool {
+	return target == e.Failure.err()
+}
+
+func dispatchFailed(f DispatchFailure, svcMeth string, format string, a ...interface{}) replyMsg {
+	return replyMsg{false, nil, &DispatchError{f, svcMeth, fmt.Sprintf(format, a...)}}
 }
 
 type ClientEnd struct {
 	endname interface{}   // this end-point's name
 	ch      chan reqMsg   // copy of Network.endCh
 	done    chan struct{} // closed when Network is cleaned up
+	net     *Network      // the Network, if made by MakeEnd()
+	tcp     *tcpTransport // set if made by MakeTCPEnd() rather than a Network
+
+	mu           sync.Mutex
+	interceptors []ClientInterceptor
 }
 
 // send an RPC, wait for the reply.
 // the return value indicates success; false means that
-// no reply was received from the server.
+// no reply was received from the server, or that it
+// couldn't be used (see CallContext() for why).
 func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return e.CallContext(context.Background(), svcMeth, args, reply) == nil
+}
+
+// send an RPC, wait for the reply or for ctx to be done.
+// it returns nil if the reply is valid; otherwise ctx.Err() if ctx is
+// done first, or one of ErrTimeout, ErrUnreachable, ErrServerDead and
+// ErrDecode, ErrRejected, or an error from a ClientInterceptor. the
+// server may still execute an RPC the caller gave up on.
+func (e *ClientEnd) CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+	e.mu.Lock()
+	interceptors := e.interceptors
+	e.mu.Unlock()
+	if len(interceptors) == 0 {
+		return e.call(ctx, svcMeth, args, reply)
+	}
+	return chainClient(interceptors, e.call)(ctx, svcMeth, args, reply)
+}
+
+// call sends the RPC, past the interceptors.
+func (e *ClientEnd) call(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	req := reqMsg{}
 	req.endname = e.endname
 	req.svcMeth = svcMeth
 	req.argsType = reflect.TypeOf(args)
-	req.replyCh = make(chan replyMsg)
+	req.replyCh = make(chan replyMsg, 1) // the network replies even if we've given up
 
 	qb := new(bytes.Buffer)
 	qe := labgob.NewEncoder(qb)
@@ -97,31 +221,51 @@ func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bo
 	}
 	req.args = qb.Bytes()
 
-	//
-	// send the request.
-	//
-	select {
-	case e.ch <- req:
-		// the request has been sent.
-	case <-e.done:
-		// entire Network has been destroyed.
-		return false
-	}
+	var rep replyMsg
+	if e.tcp != nil {
+		rep = e.tcp.call(ctx, req)
+	} else {
+		//
+		// send the request.
+		//
+		if e.net.sim != nil {
+			// in a simulation the Network has no goroutine to receive it.
+			select {
+			case <-e.done:
+				return ErrUnreachable
+			default:
+			}
+			e.net.accept(req)
+		} else {
+			select {
+			case e.ch <- req:
+				// the request has been sent.
+			case <-e.done:
+				// entire Network has been destroyed.
+				return ErrUnreachable
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
 
-	//
-	// wait for the reply.
-	//
-	rep := <-req.replyCh
-	if rep.ok {
-		rb := bytes.NewBuffer(rep.reply)
-		rd := labgob.NewDecoder(rb)
-		if err := rd.Decode(reply); err != nil {
-			log.Fatalf("ClientEnd.Call(): decode reply: %v\n", err)
+		//
+		// wait for the reply.
+		//
+		var got bool
+		if rep, got = labsim.RecvOr(e.net.sim, req.replyCh, ctx.Done()); !got {
+			return ctx.Err()
 		}
-		return true
-	} else {
-		return false
 	}
+	if !rep.ok {
+		return rep.err
+	}
+
+	rb := bytes.NewBuffer(rep.reply)
+	rd := labgob.NewDecoder(rb)
+	if err := rd.Decode(reply); err != nil {
+		return fmt.Errorf("%w: %v", ErrDecode, err)
+	}
+	return nil
 }
 
 type Network struct {
@@ -129,34 +273,35 @@ type Network struct {
 	reliable       bool
 	longDelays     bool                        // pause a long time on send on disabled connection
 	longReordering bool                        // sometimes delay replies a long time
+	dupRate        float64                     // chance a request is delivered again later
+	staleRate      float64                     // chance the caller gets the late copy's reply
 	ends           map[interface{}]*ClientEnd  // ends, by name
 	enabled        map[interface{}]bool        // by end name
 	servers        map[interface{}]*Server     // servers, by name
 	connections    map[interface{}]interface{} // endname -> servername
+	hosts          map[interface{}]interface{} // endname -> servername it's on, if set
+	groups         [][]interface{}             // from Partition(); nil if none
+	cut            map[[2]interface{}]bool     // [from, to] servernames of cut links
+	links          map[[2]interface{}]*link    // [from, to] -> its policy, see link.go
 	endCh          chan reqMsg
 	done           chan struct{} // closed when Network is cleaned up
+	sim            *labsim.Sim   // the simulation it runs in; nil for real time and math/rand
+	rec            *recorder     // nil unless recording, see record.go
 	count          int32         // total RPC count, for statistics
 	bytes          int64         // total bytes send, for statistics
+	methodStats    map[string]*Stats
+	linkStats      map[[2]interface{}]*Stats
 }
 
 func MakeNetwork() *Network {
-	rn := &Network{}
-	rn.reliable = true
-	rn.ends = map[interface{}]*ClientEnd{}
-	rn.enabled = map[interface{}]bool{}
-	rn.servers = map[interface{}]*Server{}
-	rn.connections = map[interface{}](interface{}){}
-	rn.endCh = make(chan reqMsg)
-	rn.done = make(chan struct{})
+	rn := newNetwork()
 
 	// single goroutine to handle all ClientEnd.Call()s
 	go func() {
 		for {
 			select {
 			case xreq := <-rn.endCh:
-				atomic.AddInt32(&rn.count, 1)
-				atomic.AddInt64(&rn.bytes, int64(len(xreq.args)))
-				go rn.processReq(xreq)
+				rn.accept(xreq)
 			case <-rn.done:
 				return
 			}
@@ -166,6 +311,39 @@ func MakeNetwork() *Network {
 	return rn
 }
 
+// make a Network that runs in the simulation s.
+func MakeSimNetwork(s *labsim.Sim) *Network {
+	rn := newNetwork()
+	rn.sim = s
+	return rn
+}
+
+func newNetwork() *Network {
+	rn := &Network{}
+	rn.reliable = true
+	rn.ends = map[interface{}]*ClientEnd{}
+	rn.enabled = map[interface{}]bool{}
+	rn.servers = map[interface{}]*Server{}
+	rn.connections = map[interface{}](interface{}){}
+	rn.hosts = map[interface{}]interface{}{}
+	rn.cut = map[[2]interface{}]bool{}
+	rn.links = map[[2]interface{}]*link{}
+	rn.methodStats = map[string]*Stats{}
+	rn.linkStats = map[[2]interface{}]*Stats{}
+	rn.endCh = make(chan reqMsg)
+	rn.done = make(chan struct{})
+	return rn
+}
+
+// accept a request a ClientEnd sent, and start processing it.
+func (rn *Network) accept(req reqMsg) {
+	atomic.AddInt32(&rn.count, 1)
+	atomic.AddInt64(&rn.bytes, int64(len(req.args)))
+	req.sent = rn.sim.Now()
+	req.rec = rn.newRecord(req)
+	rn.sim.Go(func() { rn.processReq(req) })
+}
+
 func (rn *Network) Cleanup() {
 	close(rn.done)
 }
@@ -184,6 +362,27 @@ func (rn *Network) LongReordering(yes bool) {
 	rn.longReordering = yes
 }
 
+// deliver a fraction rate of the requests to the server a second time,
+// up to maxRedeliveryDelay after the first, as a client that retries or a
+// network that duplicates packets might. the copy may arrive after
+// requests sent later; its reply is discarded (but see StaleReplies()).
+func (rn *Network) Duplicate(rate float64) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.dupRate = rate
+}
+
+// have the caller of a fraction rate of the requests Duplicate() delivers
+// twice get the reply to the late copy, rather than the first, so that it
+// reflects whatever the server did in between.
+func (rn *Network) StaleReplies(rate float64) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.staleRate = rate
+}
+
 func (rn *Network) LongDelays(yes bool) {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
@@ -201,12 +400,49 @@ func (rn *Network) readEndnameInfo(endname interface{}) (enabled bool,
 	servername = rn.connections[endname]
 	if servername != nil {
 		server = rn.servers[servername]
+		enabled = enabled && rn.linkUp(rn.hosts[endname], servername)
 	}
 	reliable = rn.reliable
 	longreordering = rn.longReordering
 	return
 }
 
+// linkUp says whether messages from server from (nil for an end not on
+// any server) reach server to. called with rn.mu held.
+func (rn *Network) linkUp(from interface{}, to interface{}) bool {
+	if from == nil || from == to {
+		return true
+	}
+	if rn.cut[[2]interface{}{from, to}] {
+		return false
+	}
+	if rn.groups == nil {
+		return true
+	}
+	for _, g := range rn.groups {
+		in := 0
+		for _, s := range g {
+			if s == from || s == to {
+				in++
+			}
+		}
+		if in == 2 {
+			return true
+		}
+	}
+	return false
+}
+
+// replyLost says whether the reply to endname's request is lost on the
+// way back from servername.
+func (rn *Network) replyLost(endname interface{}, servername interface{}) bool {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	from := rn.hosts[endname]
+	return from != nil && !rn.linkUp(servername, from)
+}
+
 func (rn *Network) isServerDead(endname interface{}, servername interface{}, server *Server) bool {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
@@ -217,79 +453,125 @@ func (rn *Network) isServerDead(endname interface{}, servername interface{}, ser
 	return false
 }
 
+// execute the request (call the RPC handler), and return the
+// reply; false if the server was killed in the meantime.
+func (rn *Network) execute(req reqMsg, servername interface{}, server *Server) (replyMsg, bool) {
+	// in a separate thread so that we can periodically check
+	// if the server has been killed and the RPC should get a
+	// failure reply.
+	ech := make(chan replyMsg, 1)
+	rn.sim.Go(func() {
+		run := req.rec.startRun(rn.sim.Now())
+		r := server.dispatch(req)
+		req.rec.endRun(run, r)
+		ech <- r
+	})
+
+	// wait for handler to return,
+	// but stop waiting if DeleteServer() has been called,
+	// and return an error.
+	var reply replyMsg
+	replyOK := false
+	serverDead := false
+	for replyOK == false && serverDead == false {
+		reply, replyOK = labsim.RecvOr(rn.sim, ech, rn.sim.After(100*time.Millisecond))
+		if !replyOK {
+			serverDead = rn.isServerDead(req.endname, servername, server)
+		}
+	}
+
+	// do not reply if DeleteServer() has been called, i.e.
+	// the server has been killed. this is needed to avoid
+	// situation in which a client gets a positive reply
+	// to an Append, but the server persisted the update
+	// into the old Persister. config.go is careful to call
+	// DeleteServer() before superseding the Persister.
+	serverDead = rn.isServerDead(req.endname, servername, server)
+
+	return reply, replyOK && !serverDead
+}
+
+const maxRedeliveryDelay = 1000 // ms
+
+// deliver req to the server, perhaps twice (see Duplicate()), and return
+// the reply the caller gets; false if the server was killed.
+func (rn *Network) deliver(req reqMsg, servername interface{}, server *Server) (replyMsg, bool) {
+	rn.mu.Lock()
+	dup := rn.sim.Float64() < rn.dupRate
+	stale := dup && rn.sim.Float64() < rn.staleRate
+	ms := rn.sim.Intn(maxRedeliveryDelay)
+	rn.mu.Unlock()
+
+	if !dup {
+		return rn.execute(req, servername, server)
+	}
+	rn.countDup(req, servername)
+	req.rec.hold(stale)
+
+	type result struct {
+		reply replyMsg
+		ok    bool
+	}
+	late := make(chan result, 1)
+	rn.sim.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+		reply, ok := rn.execute(req, servername, server)
+		late <- result{reply, ok}
+		req.rec.release()
+	})
+	reply, ok := rn.execute(req, servername, server)
+	if stale {
+		r, _ := labsim.Recv(rn.sim, late)
+		return r.reply, r.ok
+	}
+	return reply, ok
+}
+
 func (rn *Network) processReq(req reqMsg) {
 	enabled, servername, server, reliable, longreordering := rn.readEndnameInfo(req.endname)
 
 	if enabled && servername != nil && server != nil {
+		if l := rn.linkOf(req.endname, servername); l != nil {
+			// the link's policy replaces reliable and longreordering
+			rn.processReqLink(req, servername, server, l)
+			return
+		}
+
 		if reliable == false {
 			// short delay
-			ms := (rand.Int() % 27)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+			ms := (rn.sim.Int() % 27)
+			rn.sim.Sleep(time.Duration(ms) * time.Millisecond)
 		}
 
-		if reliable == false && (rand.Int()%1000) < 100 {
+		if reliable == false && (rn.sim.Int()%1000) < 100 {
 			// drop the request, return as if timeout
-			req.replyCh <- replyMsg{false, nil}
+			rn.replyTo(req, servername, replyMsg{false, nil, ErrTimeout}, RequestLost)
 			return
 		}
 
-		// execute the request (call the RPC handler).
-		// in a separate thread so that we can periodically check
-		// if the server has been killed and the RPC should get a
-		// failure reply.
-		ech := make(chan replyMsg)
-		go func() {
-			r := server.dispatch(req)
-			ech <- r
-		}()
-
-		// wait for handler to return,
-		// but stop waiting if DeleteServer() has been called,
-		// and return an error.
-		var reply replyMsg
-		replyOK := false
-		serverDead := false
-		for replyOK == false && serverDead == false {
-			select {
-			case reply = <-ech:
-				replyOK = true
-			case <-time.After(100 * time.Millisecond):
-				serverDead = rn.isServerDead(req.endname, servername, server)
-				if serverDead {
-					go func() {
-						<-ech // drain channel to let the goroutine created earlier terminate
-					}()
-				}
-			}
-		}
-
-		// do not reply if DeleteServer() has been called, i.e.
-		// the server has been killed. this is needed to avoid
-		// situation in which a client gets a positive reply
-		// to an Append, but the server persisted the update
-		// into the old Persister. config.go is careful to call
-		// DeleteServer() before superseding the Persister.
-		serverDead = rn.isServerDead(req.endname, servername, server)
+		reply, replyOK := rn.deliver(req, servername, server)
 
-		if replyOK == false || serverDead == true {
+		if replyOK == false {
 			// server was killed while we were waiting; return error.
-			req.replyCh <- replyMsg{false, nil}
-		} else if reliable == false && (rand.Int()%1000) < 100 {
+			rn.replyTo(req, servername, replyMsg{false, nil, ErrServerDead}, ServerDead)
+		} else if rn.replyLost(req.endname, servername) {
+			// the link back is cut, return as if timeout
+			rn.replyTo(req, servername, replyMsg{false, nil, ErrTimeout}, ReplyLost)
+		} else if reliable == false && (rn.sim.Int()%1000) < 100 {
 			// drop the reply, return as if timeout
-			req.replyCh <- replyMsg{false, nil}
-		} else if longreordering == true && rand.Intn(900) < 600 {
+			rn.replyTo(req, servername, replyMsg{false, nil, ErrTimeout}, ReplyLost)
+		} else if longreordering == true && rn.sim.Intn(900) < 600 {
 			// delay the response for a while
-			ms := 200 + rand.Intn(1+rand.Intn(2000))
+			ms := 200 + rn.sim.Intn(1+rn.sim.Intn(2000))
 			// Russ points out that this timer arrangement will decrease
 			// the number of goroutines, so that the race
 			// detector is less likely to get upset.
-			time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+			rn.sim.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
 				atomic.AddInt64(&rn.bytes, int64(len(reply.reply)))
-				req.replyCh <- reply
+				rn.replyTo(req, servername, reply, ReplyDelayed)
 			})
 		} else {
 			atomic.AddInt64(&rn.bytes, int64(len(reply.reply)))
-			req.replyCh <- reply
+			rn.replyTo(req, servername, reply, Delivered)
 		}
 	} else {
 		// simulate no reply and eventual timeout.
@@ -297,14 +579,14 @@ func (rn *Network) processReq(req reqMsg) {
 		if rn.longDelays {
 			// let Raft tests check that leader doesn't send
 			// RPCs synchronously.
-			ms = (rand.Int() % 7000)
+			ms = (rn.sim.Int() % 7000)
 		} else {
 			// many kv tests require the client to try each
 			// server in fairly rapid succession.
-			ms = (rand.Int() % 100)
+			ms = (rn.sim.Int() % 100)
 		}
-		time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
-			req.replyCh <- replyMsg{false, nil}
+		rn.sim.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+			rn.replyTo(req, servername, replyMsg{false, nil, ErrUnreachable}, Unreachable)
 		})
 	}
 
@@ -324,6 +606,7 @@ func (rn *Network) MakeEnd(endname interface{}) *ClientEnd {
 	e.endname = endname
 	e.ch = rn.endCh
 	e.done = rn.done
+	e.net = rn
 	rn.ends[endname] = e
 	rn.enabled[endname] = false
 	rn.connections[endname] = nil
@@ -336,6 +619,9 @@ func (rn *Network) AddServer(servername interface{}, rs *Server) {
 	defer rn.mu.Unlock()
 
 	rn.servers[servername] = rs
+	rs.mu.Lock()
+	rs.sim = rn.sim
+	rs.mu.Unlock()
 }
 
 func (rn *Network) DeleteServer(servername interface{}) {
@@ -362,6 +648,45 @@ func (rn *Network) Enable(endname interface{}, enabled bool) {
 	rn.enabled[endname] = enabled
 }
 
+// say that a ClientEnd is on the named server's host, so that
+// Partition() and CutLink() apply to it. an end without a host
+// isn't affected by them.
+func (rn *Network) SetHost(endname interface{}, servername interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.hosts[endname] = servername
+}
+
+// split the network into groups of servers (names). a server can reach
+// another only if some group has them both; a server in more than one
+// group bridges them, and one in none can't reach anyone. a Partition()
+// replaces the one before it.
+func (rn *Network) Partition(groups ...[]interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.groups = groups
+}
+
+// lose the requests and replies that server from sends to server to,
+// while those that to sends to from still get through.
+func (rn *Network) CutLink(from interface{}, to interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.cut[[2]interface{}{from, to}] = true
+}
+
+// undo Partition() and CutLink(): every server can reach every other.
+func (rn *Network) Heal() {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.groups = nil
+	rn.cut = map[[2]interface{}]bool{}
+}
+
 // get a server's count of incoming RPCs.
 func (rn *Network) GetCount(servername interface{}) int {
 	rn.mu.Lock()
@@ -385,14 +710,18 @@ func (rn *Network) GetTotalBytes() int64 {
 // the same rpc dispatcher. so that e.g. both a Raft
 // and a k/v server can listen to the same rpc endpoint.
 type Server struct {
-	mu       sync.Mutex
-	services map[string]*Service
-	count    int // incoming RPCs
+	mu           sync.Mutex
+	services     map[string]*Service
+	count        int // incoming RPCs
+	interceptors []ServerInterceptor
+	stats        map[string]*Stats // by service method
+	sim          *labsim.Sim       // of the Network it was added to, for Stats()
 }
 
 func MakeServer() *Server {
 	rs := &Server{}
 	rs.services = map[string]*Service{}
+	rs.stats = map[string]*Stats{}
 	return rs
 }
 
@@ -404,29 +733,45 @@ func (rs *Server) AddService(svc *Service) {
 
 func (rs *Server) dispatch(req reqMsg) replyMsg {
 	rs.mu.Lock()
-
 	rs.count += 1
+	sim := rs.sim
+	rs.mu.Unlock()
+
+	t0 := sim.Now()
+	r := rs.route(req)
+	rs.countCall(req, r, sim.Since(t0))
+	return r
+}
+
+// route req to its service.
+func (rs *Server) route(req reqMsg) replyMsg {
+	rs.mu.Lock()
 
 	// split Raft.AppendEntries into service and method
 	dot := strings.LastIndex(req.svcMeth, ".")
+	if dot < 0 {
+		rs.mu.Unlock()
+		return dispatchFailed(UnknownMethod, req.svcMeth, "expecting Service.Method")
+	}
 	serviceName := req.svcMeth[:dot]
 	methodName := req.svcMeth[dot+1:]
 
 	service, ok := rs.services[serviceName]
+	interceptors := rs.interceptors
 
-	rs.mu.Unlock()
-
-	if ok {
-		return service.dispatch(methodName, req)
-	} else {
+	if !ok {
 		choices := []string{}
 		for k, _ := range rs.services {
 			choices = append(choices, k)
 		}
-		log.Fatalf("labrpc.Server.dispatch(): unknown service %v in %v.%v; expecting one of %v\n",
-			serviceName, serviceName, methodName, choices)
-		return replyMsg{false, nil}
+		rs.mu.Unlock()
+		sort.Strings(choices)
+		return dispatchFailed(UnknownService, req.svcMeth, "expecting one of %v", choices)
 	}
+
+	rs.mu.Unlock()
+
+	return service.dispatch(methodName, req, interceptors)
 }
 
 func (rs *Server) GetCount() int {
@@ -475,39 +820,59 @@ func MakeService(rcvr interface{}) *Service {
 	return svc
 }
 
-func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
+func (svc *Service) dispatch(methname string, req reqMsg, interceptors []ServerInterceptor) replyMsg {
 	if method, ok := svc.methods[methname]; ok {
 		// prepare space into which to read the argument.
 		// the Value's type will be a pointer to req.argsType.
-		args := reflect.New(req.argsType)
+		argsType := req.argsType
+		if argsType == nil {
+			// the caller is in another process; the handler says what it sent
+			argsType = method.Type.In(1)
+		}
+		if !argsType.AssignableTo(method.Type.In(1)) {
+			return dispatchFailed(BadArgs, req.svcMeth, "got %v, expecting %v", argsType, method.Type.In(1))
+		}
+		args := reflect.New(argsType)
 
 		// decode the argument.
 		ab := bytes.NewBuffer(req.args)
 		ad := labgob.NewDecoder(ab)
-		ad.Decode(args.Interface())
+		if err := ad.Decode(args.Interface()); err != nil {
+			return dispatchFailed(BadArgs, req.svcMeth, "%v", err)
+		}
 
 		// allocate space for the reply.
 		replyType := method.Type.In(2)
 		replyType = replyType.Elem()
 		replyv := reflect.New(replyType)
 
-		// call the method.
+		// call the method, through the interceptors.
 		function := method.Func
-		function.Call([]reflect.Value{svc.rcvr, args.Elem(), replyv})
+		if len(interceptors) == 0 {
+			function.Call([]reflect.Value{svc.rcvr, args.Elem(), replyv})
+		} else {
+			handle := func(a interface{}, r interface{}) error {
+				function.Call([]reflect.Value{svc.rcvr, reflect.ValueOf(a), reflect.ValueOf(r)})
+				return nil
+			}
+			err := chainServer(interceptors, req.endname, req.svcMeth, handle)(args.Elem().Interface(), replyv.Interface())
+			if err != nil {
+				return replyMsg{false, nil, &RejectedError{err.Error()}}
+			}
+		}
 
 		// encode the reply.
 		rb := new(bytes.Buffer)
 		re := labgob.NewEncoder(rb)
 		re.EncodeValue(replyv)
 
-		return replyMsg{true, rb.Bytes()}
+		return replyMsg{true, rb.Bytes(), nil}
 	} else {
 		choices := []string{}
 		for k, _ := range svc.methods {
 			choices = append(choices, k)
 		}
-		log.Fatalf("labrpc.Service.dispatch(): unknown method %v in %v; expecting one of %v\n",
-			methname, req.svcMeth, choices)
-		return replyMsg{false, nil}
+		sort.Strings(choices)
+		return dispatchFailed(UnknownMethod, req.svcMeth, "expecting one of %v", choices)
 	}
 }
@@ -0,0 +1,167 @@
+package labrpc
+
+//
+// per-link network conditions, e.g. to model servers spread over several
+// datacenters.
+//
+// net.SetLinkPolicy(from, to, policy) -- the requests that ends on server
+//   from (see SetHost(); or the end named from, if it has no host) send to
+//   server to, and their replies, get policy's latency, loss, duplication
+//   and bandwidth.
+// net.DeleteLinkPolicy(from, to) -- back to Reliable() and LongReordering().
+//
+// a link with a policy ignores Reliable() and LongReordering(); Enable(),
+// Partition() and CutLink() still apply.
+//
+// each message, the request and then the reply, takes Latency plus some
+// jitter to arrive, and is lost with probability DropRate. a link with a
+// Bandwidth transmits one message at a time in each direction, each for
+// its encoded size divided by Bandwidth, so messages queue up behind big
+// ones. a request is delivered twice with probability DupRate; the
+// caller gets the first reply, and the other is discarded. Duplicate()
+// and StaleReplies() apply on top of that.
+//
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// JitterDist is how a link's delays spread beyond its Latency.
+type JitterDist int
+
+const (
+	JitterUniform     JitterDist = iota // up to Jitter more, uniformly
+	JitterNormal                        // normally, with standard deviation Jitter (but never below 0)
+	JitterExponential                   // exponentially, with mean Jitter: mostly a little, now and then a lot
+)
+
+type LinkPolicy struct {
+	Latency   time.Duration // one way
+	Jitter    time.Duration
+	Dist      JitterDist
+	DropRate  float64 // chance that a request, or a reply, is lost
+	DupRate   float64 // chance that a request is delivered twice
+	Bandwidth int64   // bytes per second each way; 0 for no limit
+}
+
+// link is the state of a link with a policy, guarded by Network.mu.
+type link struct {
+	policy LinkPolicy
+	busy   [2]time.Time // until when requests, and replies, are being transmitted
+}
+
+const (
+	toServer = 0
+	toClient = 1
+)
+
+// give the link from ends on server from (or the end named from) to
+// server to a policy.
+func (rn *Network) SetLinkPolicy(from interface{}, to interface{}, policy LinkPolicy) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.links[[2]interface{}{from, to}] = &link{policy: policy}
+}
+
+// take the policy away from the link from ends on server from to server to.
+func (rn *Network) DeleteLinkPolicy(from interface{}, to interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	delete(rn.links, [2]interface{}{from, to})
+}
+
+// linkOf returns the link from endname to servername, nil if it has no policy.
+func (rn *Network) linkOf(endname interface{}, servername interface{}) *link {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	from := rn.hosts[endname]
+	if from == nil {
+		from = endname
+	}
+	return rn.links[[2]interface{}{from, servername}]
+}
+
+// delay returns how long a message of size bytes takes over l in
+// direction dir, starting now, and books the link's bandwidth for it.
+func (rn *Network) delay(l *link, dir int, size int) time.Duration {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	p := &l.policy
+	d := p.Latency
+	if p.Jitter > 0 {
+		switch p.Dist {
+		case JitterUniform:
+			d += time.Duration(rn.sim.Int63n(int64(p.Jitter)))
+		case JitterNormal:
+			d += time.Duration(rn.sim.NormFloat64() * float64(p.Jitter))
+		case JitterExponential:
+			d += time.Duration(rn.sim.ExpFloat64() * float64(p.Jitter))
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+
+	if p.Bandwidth > 0 {
+		now := rn.sim.Now()
+		start := l.busy[dir]
+		if start.Before(now) {
+			start = now
+		}
+		l.busy[dir] = start.Add(time.Duration(int64(size) * int64(time.Second) / p.Bandwidth))
+		d += l.busy[dir].Sub(now)
+	}
+	return d
+}
+
+// lost says whether a message over l is lost.
+func (rn *Network) lost(l *link) bool {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	return rn.sim.Float64() < l.policy.DropRate
+}
+
+func (rn *Network) duplicated(l *link) bool {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	return rn.sim.Float64() < l.policy.DupRate
+}
+
+// processReqLink is processReq() for a request over a link with a policy.
+func (rn *Network) processReqLink(req reqMsg, servername interface{}, server *Server, l *link) {
+	rn.sim.Sleep(rn.delay(l, toServer, len(req.args)))
+	if rn.lost(l) {
+		// return as if timeout
+		rn.replyTo(req, servername, replyMsg{false, nil, ErrTimeout}, RequestLost)
+		return
+	}
+
+	if rn.duplicated(l) {
+		rn.countDup(req, servername)
+		req.rec.hold(false)
+		rn.sim.Go(func() {
+			rn.execute(req, servername, server)
+			req.rec.release()
+		})
+	}
+	reply, ok := rn.deliver(req, servername, server)
+
+	if !ok {
+		rn.replyTo(req, servername, replyMsg{false, nil, ErrServerDead}, ServerDead)
+	} else if rn.replyLost(req.endname, servername) || rn.lost(l) {
+		// return as if timeout
+		rn.replyTo(req, servername, replyMsg{false, nil, ErrTimeout}, ReplyLost)
+	} else {
+		rn.sim.AfterFunc(rn.delay(l, toClient, len(reply.reply)), func() {
+			atomic.AddInt64(&rn.bytes, int64(len(reply.reply)))
+			rn.replyTo(req, servername, reply, Delivered)
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package labrpc
+
+//
+// recording the RPCs that go over a Network, and replaying them into a
+// Server, to find out offline what a handler did with what it got.
+//
+// net.StartRecording(w) -- from now on, write a Record of each request
+//   to w, as a line of JSON, once its caller has the reply (or has been
+//   told there is none) and the server is done with any copy of it.
+// net.StopRecording() -- stop, and return the first error writing to w.
+// records, err := ReadRecords(r) -- read what StartRecording() wrote.
+// n, err := Replay(srv, servername, records) -- call srv's handlers with
+//   the requests that reached the server named servername, in the order
+//   they did, and check that they reply as they did then.
+//
+// a Record has what the caller sent, when, what the network decided to
+// do with it, and each time the server ran the handler for it (twice if
+// Duplicate() delivered it again) with the reply. times are since
+// StartRecording(), on the Network's clock, which is virtual in a
+// simulation.
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Decision is what the Network did with a request.
+type Decision string
+
+const (
+	Delivered    Decision = "delivered"
+	ReplyDelayed Decision = "reply delayed" // delivered, after a long delay (LongReordering())
+	RequestLost  Decision = "request lost"
+	ReplyLost    Decision = "reply lost"
+	ServerDead   Decision = "server dead"
+	Unreachable  Decision = "unreachable" // the end is disabled, or not connected
+)
+
+type Record struct {
+	Seq        int           // in the order the requests were sent
+	Sent       time.Duration // since StartRecording()
+	Done       time.Duration // when the caller got the reply, or gave up on it
+	End        string        // the sending ClientEnd's name
+	Server     string        // the name of the server it is connected to, if any
+	SvcMeth    string
+	Args       []byte // labgob-encoded
+	Decision   Decision
+	Duplicated bool  // the server got it twice, see Duplicate()
+	Stale      bool  // the caller got the reply to the second copy
+	Runs       []Run // the handler calls, in the order they started
+
+	r        *recorder
+	answered bool // the caller has its reply
+	held     int  // copies still to be run, see hold()
+}
+
+// Run is a call of the handler for a request.
+type Run struct {
+	Order int           // among all the handler calls in the recording
+	At    time.Duration // when it started
+	OK    bool          // false if it hadn't returned when the caller got its answer
+	Reply []byte        // labgob-encoded, if OK
+}
+
+type recorder struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	start   time.Time
+	seq     int
+	runs    int
+	err     error // the first from enc
+	stopped bool
+}
+
+// write a Record of every request from now on to w. a recording
+// already in progress stops.
+func (rn *Network) StartRecording(w io.Writer) {
+	rn.StopRecording()
+
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.rec = &recorder{enc: json.NewEncoder(w), start: rn.sim.Now()}
+}
+
+// stop recording; the requests still in flight aren't written. returns
+// the first error writing.
+func (rn *Network) StopRecording() error {
+	rn.mu.Lock()
+	r := rn.rec
+	rn.rec = nil
+	rn.mu.Unlock()
+
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = true
+	return r.err
+}
+
+// newRecord starts the Record of req, if recording.
+func (rn *Network) newRecord(req reqMsg) *Record {
+	rn.mu.Lock()
+	r := rn.rec
+	rn.mu.Unlock()
+
+	if r == nil {
+		return nil
+	}
+	now := rn.sim.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	return &Record{
+		Seq:     r.seq,
+		Sent:    now.Sub(r.start),
+		End:     fmt.Sprint(req.endname),
+		SvcMeth: req.svcMeth,
+		Args:    req.args,
+		r:       r,
+	}
+}
+
+// the methods below do nothing if rec is nil, i.e. when not recording.
+
+// startRun notes that the handler is being called for the request, and
+// returns the index of the Run.
+func (rec *Record) startRun(now time.Time) int {
+	if rec == nil {
+		return -1
+	}
+	rec.r.mu.Lock()
+	defer rec.r.mu.Unlock()
+	rec.r.runs++
+	rec.Runs = append(rec.Runs, Run{Order: rec.r.runs, At: now.Sub(rec.r.start)})
+	return len(rec.Runs) - 1
+}
+
+func (rec *Record) endRun(i int, reply replyMsg) {
+	if rec == nil {
+		return
+	}
+	rec.r.mu.Lock()
+	defer rec.r.mu.Unlock()
+	rec.Runs[i].OK = reply.ok
+	rec.Runs[i].Reply = reply.reply
+}
+
+// hold keeps rec from being written until release(), for a copy of the
+// request that will be delivered after the caller has its reply.
+func (rec *Record) hold(stale bool) {
+	if rec == nil {
+		return
+	}
+	rec.r.mu.Lock()
+	defer rec.r.mu.Unlock()
+	rec.Duplicated = true
+	rec.Stale = stale
+	rec.held++
+}
+
+func (rec *Record) release() {
+	if rec == nil {
+		return
+	}
+	rec.r.mu.Lock()
+	defer rec.r.mu.Unlock()
+	rec.held--
+	rec.write()
+}
+
+// finish notes what happened to the request, now that the caller has
+// its reply.
+func (rec *Record) finish(servername interface{}, d Decision, now time.Time) {
+	if rec == nil {
+		return
+	}
+	rec.r.mu.Lock()
+	defer rec.r.mu.Unlock()
+	if servername != nil {
+		rec.Server = fmt.Sprint(servername)
+	}
+	rec.Decision = d
+	rec.Done = now.Sub(rec.r.start)
+	rec.answered = true
+	rec.write()
+}
+
+// write rec, if it is complete. called with rec.r.mu held.
+func (rec *Record) write() {
+	r := rec.r
+	if !rec.answered || rec.held > 0 || r.stopped || r.err != nil {
+		return
+	}
+	r.err = r.enc.Encode(rec)
+}
+
+// replyTo gives the caller of req its reply, and records and counts what
+// happened.
+func (rn *Network) replyTo(req reqMsg, servername interface{}, reply replyMsg, d Decision) {
+	req.rec.finish(servername, d, rn.sim.Now())
+	rn.countCall(req, servername, reply, d)
+	req.replyCh <- reply
+}
+
+// read the Records StartRecording() wrote to r.
+func ReadRecords(r io.Reader) ([]Record, error) {
+	records := []Record{}
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+// ReplayError says which handler call replied differently in Replay().
+type ReplayError struct {
+	Seq     int // of the Record
+	SvcMeth string
+	Order   int // of the Run
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("labrpc: replaying request %d (%v), run %d, got a different reply",
+		e.Seq, e.SvcMeth, e.Order)
+}
+
+// Replay calls the handlers of rs with the requests in records that
+// reached the server named servername, as many times as they did then,
+// and in the same order. it stops at the first call that replies
+// differently than it did then, with a *ReplayError, and returns the
+// number of calls it made before that. the calls that hadn't returned
+// when the Record was written are made, but not checked.
+func Replay(rs *Server, servername string, records []Record) (int, error) {
+	type call struct {
+		rec *Record
+		run Run
+	}
+	calls := []call{}
+	for i := range records {
+		if records[i].Server != servername {
+			continue
+		}
+		for _, run := range records[i].Runs {
+			calls = append(calls, call{&records[i], run})
+		}
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].run.Order < calls[j].run.Order })
+
+	n := 0
+	for _, c := range calls {
+		// argsType is left nil; the Service takes it from the handler.
+		reply := rs.dispatch(reqMsg{endname: c.rec.End, svcMeth: c.rec.SvcMeth, args: c.rec.Args})
+		if c.run.OK && !bytes.Equal(reply.reply, c.run.Reply) {
+			return n, &ReplayError{c.rec.Seq, c.rec.SvcMeth, c.run.Order}
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,240 @@
+package labrpc
+
+//
+// statistics of the calls, by service method and by link, to see e.g.
+// how much of the traffic is heartbeats and how much log shipping.
+//
+// st := net.Stats() -- the calls so far: st.Methods["Raft.AppendEntries"]
+//   for a service method, st.Links[[2]interface{}{from, to}] for the
+//   calls that ends on server from (see SetHost(); or the end named from,
+//   if it has no host) made to server to.
+// net.LinkStats(from, to) -- just the calls over that link.
+// net.ResetStats() -- start over from zero.
+// srv.Stats() -- the calls srv dispatched, by service method.
+//
+// a call counts on a Network once its caller has the reply, or has been
+// told there is none; the calls still in flight don't count yet. a call
+// over a cut link, or one its link's policy loses, counts as a drop on
+// the link; one delivered twice, by Duplicate() or the policy's DupRate,
+// counts as a dup as soon as it is. on a Server a call counts once the
+// handler returns. GetCount(), GetTotalCount() and GetTotalBytes() go on
+// counting as they did.
+//
+
+import (
+	"fmt"
+	"time"
+)
+
+type Stats struct {
+	Calls    int64
+	Drops    int64 // got no reply: lost, unreachable, or the server died
+	Dups     int64 // delivered to the server twice
+	Errors   int64 // got a reply that says the call failed, e.g. a *DispatchError
+	BytesOut int64 // the args on a Network, the replies on a Server
+	BytesIn  int64 // the replies on a Network, the args on a Server
+	// on a Network, from the call to the reply, for the calls that got
+	// one; on a Server, how long the handler ran.
+	Latency Histogram
+}
+
+type NetworkStats struct {
+	Methods map[string]Stats
+	Links   map[[2]interface{}]Stats // [from, to] servernames, as for SetLinkPolicy()
+}
+
+// the upper bounds of the buckets of a Histogram, but the last.
+var LatencyBuckets = [...]time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+// Histogram counts durations: Counts[i] those below LatencyBuckets[i]
+// (and not in an earlier bucket), the last one the rest.
+type Histogram struct {
+	Counts [len(LatencyBuckets) + 1]int64
+	Sum    time.Duration
+	Max    time.Duration
+}
+
+func (h *Histogram) Add(d time.Duration) {
+	i := 0
+	for i < len(LatencyBuckets) && d >= LatencyBuckets[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+func (h *Histogram) Count() int64 {
+	n := int64(0)
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+func (h *Histogram) Mean() time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(n)
+}
+
+// Quantile returns a bound below which at least fraction q of the
+// durations are: the upper bound of their bucket, or Max if lower.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	n := h.Count()
+	seen := int64(0)
+	for i, c := range h.Counts {
+		seen += c
+		if c > 0 && float64(seen) >= q*float64(n) {
+			if i < len(LatencyBuckets) && LatencyBuckets[i] < h.Max {
+				return LatencyBuckets[i]
+			}
+			return h.Max
+		}
+	}
+	return 0
+}
+
+// e.g. "calls 120 drops 3 dups 0 errors 0 bytes 9000/2400 latency 12ms p99 50ms"
+func (st Stats) String() string {
+	return fmt.Sprintf("calls %d drops %d dups %d errors %d bytes %d/%d latency %v p99 %v",
+		st.Calls, st.Drops, st.Dups, st.Errors, st.BytesOut, st.BytesIn,
+		st.Latency.Mean().Round(time.Microsecond), st.Latency.Quantile(0.99).Round(time.Microsecond))
+}
+
+func (rn *Network) Stats() NetworkStats {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	st := NetworkStats{map[string]Stats{}, map[[2]interface{}]Stats{}}
+	for k, s := range rn.methodStats {
+		st.Methods[k] = *s
+	}
+	for k, s := range rn.linkStats {
+		st.Links[k] = *s
+	}
+	return st
+}
+
+// the calls from ends on server from (or the end named from) to server to.
+func (rn *Network) LinkStats(from interface{}, to interface{}) Stats {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if s := rn.linkStats[[2]interface{}{from, to}]; s != nil {
+		return *s
+	}
+	return Stats{}
+}
+
+func (rn *Network) ResetStats() {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.methodStats = map[string]*Stats{}
+	rn.linkStats = map[[2]interface{}]*Stats{}
+}
+
+// count a call, now that the caller has its answer.
+func (rn *Network) countCall(req reqMsg, servername interface{}, reply replyMsg, d Decision) {
+	now := rn.sim.Now()
+
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	for _, s := range rn.statsOf(req, servername) {
+		s.Calls++
+		s.BytesOut += int64(len(req.args))
+		if d != Delivered && d != ReplyDelayed {
+			s.Drops++
+			continue
+		}
+		if !reply.ok {
+			s.Errors++
+		}
+		s.BytesIn += int64(len(reply.reply))
+		s.Latency.Add(now.Sub(req.sent))
+	}
+}
+
+// count a request delivered a second time.
+func (rn *Network) countDup(req reqMsg, servername interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	for _, s := range rn.statsOf(req, servername) {
+		s.Dups++
+	}
+}
+
+// statsOf returns the Stats req counts in: its service method's, and its
+// link's if it has a server. called with rn.mu held.
+func (rn *Network) statsOf(req reqMsg, servername interface{}) []*Stats {
+	ms := rn.methodStats[req.svcMeth]
+	if ms == nil {
+		ms = &Stats{}
+		rn.methodStats[req.svcMeth] = ms
+	}
+	all := []*Stats{ms}
+	if servername != nil {
+		from := rn.hosts[req.endname]
+		if from == nil {
+			from = req.endname
+		}
+		k := [2]interface{}{from, servername}
+		ls := rn.linkStats[k]
+		if ls == nil {
+			ls = &Stats{}
+			rn.linkStats[k] = ls
+		}
+		all = append(all, ls)
+	}
+	return all
+}
+
+func (rs *Server) Stats() map[string]Stats {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	st := map[string]Stats{}
+	for k, s := range rs.stats {
+		st[k] = *s
+	}
+	return st
+}
+
+// count a call the server dispatched, whose handler ran for d.
+func (rs *Server) countCall(req reqMsg, reply replyMsg, d time.Duration) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	s := rs.stats[req.svcMeth]
+	if s == nil {
+		s = &Stats{}
+		rs.stats[req.svcMeth] = s
+	}
+	s.Calls++
+	if !reply.ok {
+		s.Errors++
+	}
+	s.BytesIn += int64(len(req.args))
+	s.BytesOut += int64(len(reply.reply))
+	s.Latency.Add(d)
+}
@@ -0,0 +1,286 @@
+package labrpc
+
+//
+// a transport that carries RPCs over TCP (or Unix domain sockets), so
+// the servers can run in separate processes. Call() and the dispatch
+// through Server and Service work just as they do on a Network.
+//
+// end := MakeTCPEnd(network, addr, opts) -- a client end-point for the
+//   server listening on addr; network is "tcp" or "unix", as for net.Dial.
+// end.Call("Raft.AppendEntries", &args, &reply) -- as on a Network. it
+//   returns false if the server can't be reached, the connection breaks,
+//   or the call takes longer than opts.CallTimeout.
+// end.CallContext(ctx, ...) -- as on a Network, too; ctx's deadline
+//   applies if it is earlier than opts.CallTimeout. a call that times out
+//   fails with ErrTimeout, one that can't connect with ErrUnreachable,
+//   and one whose connection breaks with ErrServerDead.
+// end.Close() -- close the end's connections; Call()s fail from then on.
+//
+// srv.Serve(l) -- serve RPCs on the connections l accepts, until l is
+//   closed.
+//
+// a connection carries one call at a time: a labgob-encoded tcpRequest,
+// then a tcpReply. an end keeps the connections of calls that succeeded
+// around for the next ones, up to opts.MaxIdle of them, and dials a new
+// one whenever none is idle; so after a server restarts, the next call
+// reconnects to it. when a call fails the idle connections are closed
+// too, since they most likely lead to the same dead server.
+//
+
+import (
+	"context"
+	"lab4/labgob"
+	"net"
+	"sync"
+	"time"
+)
+
+// TCPOptions tune a ClientEnd made by MakeTCPEnd(); zero fields get defaults.
+type TCPOptions struct {
+	DialTimeout time.Duration // default 1s
+	CallTimeout time.Duration // for the whole call, dialing included; default 5s
+	MaxIdle     int           // idle connections kept for later calls; default 4
+}
+
+const (
+	defaultDialTimeout = 1 * time.Second
+	defaultCallTimeout = 5 * time.Second
+	defaultMaxIdle     = 4
+)
+
+type tcpRequest struct {
+	SvcMeth string
+	Args    []byte
+}
+
+type tcpReply struct {
+	OK       bool
+	Reply    []byte
+	Rejected *RejectedError // set if a ServerInterceptor failed the call
+	Failed   *DispatchError // set if the server couldn't dispatch it
+}
+
+// tcpConn is a connection with the labgob streams on it.
+type tcpConn struct {
+	conn net.Conn
+	enc  *labgob.LabEncoder
+	dec  *labgob.LabDecoder
+}
+
+func newTCPConn(conn net.Conn) *tcpConn {
+	return &tcpConn{conn, labgob.NewEncoder(conn), labgob.NewDecoder(conn)}
+}
+
+// tcpTransport is the pool of connections of a ClientEnd to one server.
+type tcpTransport struct {
+	network string
+	addr    string
+	opts    TCPOptions
+	mu      sync.Mutex
+	idle    []*tcpConn
+	closed  bool
+}
+
+// create a client end-point that sends its RPCs to the server listening
+// on addr.
+func MakeTCPEnd(network string, addr string, opts TCPOptions) *ClientEnd {
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = defaultDialTimeout
+	}
+	if opts.CallTimeout <= 0 {
+		opts.CallTimeout = defaultCallTimeout
+	}
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = defaultMaxIdle
+	}
+
+	e := &ClientEnd{}
+	e.endname = addr
+	e.tcp = &tcpTransport{network: network, addr: addr, opts: opts}
+	return e
+}
+
+// Close closes the connections of an end made by MakeTCPEnd().
+func (e *ClientEnd) Close() {
+	if e.tcp == nil {
+		return
+	}
+	e.tcp.mu.Lock()
+	defer e.tcp.mu.Unlock()
+	e.tcp.closed = true
+	e.tcp.dropIdle()
+}
+
+// call sends req to the server and waits for the reply, or for ctx to be done.
+func (tt *tcpTransport) call(ctx context.Context, req reqMsg) replyMsg {
+	deadline := time.Now().Add(tt.opts.CallTimeout)
+	ctxDeadline := false
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+		ctxDeadline = true
+	}
+
+	c, err := tt.get(ctx, deadline)
+	if err != nil {
+		return replyMsg{false, nil, err}
+	}
+	c.conn.SetDeadline(deadline)
+
+	// if ctx is done first, cut the call short through the deadline
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	rep := tcpReply{}
+	err = c.enc.Encode(tcpRequest{req.svcMeth, req.args})
+	if err == nil {
+		err = c.dec.Decode(&rep)
+	}
+	close(stop)
+	<-stopped
+
+	if err != nil {
+		tt.fail(c)
+		if ctx.Err() != nil {
+			return replyMsg{false, nil, ctx.Err()}
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if ctxDeadline {
+				// the connection noticed before ctx did
+				return replyMsg{false, nil, context.DeadlineExceeded}
+			}
+			return replyMsg{false, nil, ErrTimeout}
+		}
+		return replyMsg{false, nil, ErrServerDead}
+	}
+
+	c.conn.SetDeadline(time.Time{})
+	tt.put(c)
+	if rep.Rejected != nil {
+		return replyMsg{false, nil, rep.Rejected}
+	}
+	if rep.Failed != nil {
+		return replyMsg{false, nil, rep.Failed}
+	}
+	if !rep.OK {
+		return replyMsg{false, nil, ErrServerDead}
+	}
+	return replyMsg{true, rep.Reply, nil}
+}
+
+// get returns an idle connection, or dials a new one.
+func (tt *tcpTransport) get(ctx context.Context, deadline time.Time) (*tcpConn, error) {
+	tt.mu.Lock()
+	if tt.closed {
+		tt.mu.Unlock()
+		return nil, ErrUnreachable
+	}
+	if n := len(tt.idle); n > 0 {
+		c := tt.idle[n-1]
+		tt.idle = tt.idle[:n-1]
+		tt.mu.Unlock()
+		return c, nil
+	}
+	tt.mu.Unlock()
+
+	timeout := tt.opts.DialTimeout
+	if left := time.Until(deadline); left < timeout {
+		timeout = left
+	}
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, tt.network, tt.addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, ErrUnreachable
+	}
+	return newTCPConn(conn), nil
+}
+
+// put keeps c for a later call, if there is room.
+func (tt *tcpTransport) put(c *tcpConn) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if tt.closed || len(tt.idle) >= tt.opts.MaxIdle {
+		c.conn.Close()
+		return
+	}
+	tt.idle = append(tt.idle, c)
+}
+
+// fail closes c, whose call failed, and the idle connections.
+func (tt *tcpTransport) fail(c *tcpConn) {
+	c.conn.Close()
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tt.dropIdle()
+}
+
+// called with tt.mu held.
+func (tt *tcpTransport) dropIdle() {
+	for _, c := range tt.idle {
+		c.conn.Close()
+	}
+	tt.idle = nil
+}
+
+// Serve accepts connections on l and serves the RPCs that arrive on
+// them, until l is closed. it then closes those connections too, and
+// returns the error from l.Accept().
+func (rs *Server) Serve(l net.Listener) error {
+	var mu sync.Mutex
+	conns := map[net.Conn]bool{}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for conn := range conns {
+			conn.Close()
+		}
+		conns = nil
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		conns[conn] = true
+		mu.Unlock()
+
+		go func() {
+			rs.serveConn(conn)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+}
+
+// serveConn serves the calls on conn, one after another, until it breaks.
+func (rs *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	c := newTCPConn(conn)
+	for {
+		req := tcpRequest{}
+		if err := c.dec.Decode(&req); err != nil {
+			return
+		}
+		// argsType is left nil; the Service takes it from the handler.
+		r := rs.dispatch(reqMsg{endname: conn.RemoteAddr().String(), svcMeth: req.SvcMeth, args: req.Args})
+		rep := tcpReply{OK: r.ok, Reply: r.reply}
+		rep.Rejected, _ = r.err.(*RejectedError)
+		rep.Failed, _ = r.err.(*DispatchError)
+		if err := c.enc.Encode(rep); err != nil {
+			return
+		}
+	}
+}
@@ -1,11 +1,19 @@
 package labrpc
 
 import "testing"
+import "context"
+import "errors"
 import "strconv"
 import "sync"
 import "runtime"
 import "time"
 import "fmt"
+import "net"
+import "path/filepath"
+import "lab4/labsim"
+import "bytes"
+import "os"
+import "strings"
 
 type JunkArgs struct {
 	X int
@@ -66,6 +74,14 @@ func (js *JunkServer) Handler7(args int, reply *string) {
 	}
 }
 
+// counts its calls
+func (js *JunkServer) Handler8(args int, reply *int) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.log2 = append(js.log2, args)
+	*reply = len(js.log2)
+}
+
 func TestBasic(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 
@@ -595,3 +611,1116 @@ func TestBenchmark(t *testing.T) {
 	fmt.Printf("%v for %v\n", time.Since(t0), n)
 	// march 2016, rtm laptop, 22 microseconds per RPC
 }
+
+// serve rs on a fresh listener; returns the listener.
+func serveTCP(t *testing.T, network string, addr string, rs *Server) net.Listener {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go rs.Serve(l)
+	return l
+}
+
+func TestTCP(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	l := serveTCP(t, "tcp", "127.0.0.1:0", rs)
+	defer l.Close()
+
+	e := MakeTCPEnd("tcp", l.Addr().String(), TCPOptions{})
+	defer e.Close()
+
+	{
+		reply := ""
+		if ok := e.Call("JunkServer.Handler2", 111, &reply); !ok || reply != "handler2-111" {
+			t.Fatalf("wrong reply from Handler2: %v %q", ok, reply)
+		}
+	}
+
+	{
+		var args JunkArgs
+		var reply JunkReply
+		e.Call("JunkServer.Handler4", &args, &reply)
+		if reply.X != "pointer" {
+			t.Fatalf("wrong reply from Handler4")
+		}
+	}
+
+	{
+		var args JunkArgs
+		var reply JunkReply
+		e.Call("JunkServer.Handler5", args, &reply)
+		if reply.X != "no pointer" {
+			t.Fatalf("wrong reply from Handler5")
+		}
+	}
+
+	// concurrent calls, more than the end keeps idle connections for.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				n := 100*i + j
+				reply := ""
+				if ok := e.Call("JunkServer.Handler2", n, &reply); !ok || reply != "handler2-"+strconv.Itoa(n) {
+					t.Errorf("wrong reply from Handler2: %v %q", ok, reply)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if rs.GetCount() != 203 {
+		t.Fatalf("wrong GetCount() %v, expected 203", rs.GetCount())
+	}
+}
+
+//
+// does an end reconnect to a server that comes back?
+//
+func TestTCPReconnect(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	l := serveTCP(t, "tcp", "127.0.0.1:0", rs)
+	addr := l.Addr().String()
+
+	e := MakeTCPEnd("tcp", addr, TCPOptions{DialTimeout: 100 * time.Millisecond})
+	defer e.Close()
+
+	reply := 0
+	if ok := e.Call("JunkServer.Handler1", "9099", &reply); !ok || reply != 9099 {
+		t.Fatalf("wrong reply from Handler1")
+	}
+
+	// the server goes away, connections and all.
+	l.Close()
+	time.Sleep(100 * time.Millisecond)
+	if ok := e.Call("JunkServer.Handler1", "9099", &reply); ok {
+		t.Fatalf("Call() succeeded with the server gone")
+	}
+
+	l = serveTCP(t, "tcp", addr, rs)
+	defer l.Close()
+	reply = 0
+	if ok := e.Call("JunkServer.Handler1", "111", &reply); !ok || reply != 111 {
+		t.Fatalf("no reply after the server came back")
+	}
+
+	// a closed end doesn't call anymore.
+	e.Close()
+	if ok := e.Call("JunkServer.Handler1", "111", &reply); ok {
+		t.Fatalf("Call() succeeded on a closed end")
+	}
+}
+
+//
+// does a call to a handler that doesn't return time out?
+//
+func TestTCPTimeout(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	l := serveTCP(t, "tcp", "127.0.0.1:0", rs)
+	defer l.Close()
+
+	e := MakeTCPEnd("tcp", l.Addr().String(), TCPOptions{CallTimeout: 200 * time.Millisecond})
+	defer e.Close()
+
+	t0 := time.Now()
+	reply := 0
+	if ok := e.Call("JunkServer.Handler3", 99, &reply); ok {
+		t.Fatalf("Handler3 returned")
+	}
+	if d := time.Since(t0); d > time.Second {
+		t.Fatalf("Call() took %v to time out", d)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	path := filepath.Join(t.TempDir(), "sock")
+	l := serveTCP(t, "unix", path, rs)
+	defer l.Close()
+
+	e := MakeTCPEnd("unix", path, TCPOptions{})
+	defer e.Close()
+
+	reply := ""
+	if ok := e.Call("JunkServer.Handler2", 7, &reply); !ok || reply != "handler2-7" {
+		t.Fatalf("wrong reply from Handler2: %v %q", ok, reply)
+	}
+}
+
+//
+// does CallContext() say why a call failed?
+//
+func TestCallContext(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+
+	{
+		reply := ""
+		if err := e.CallContext(context.Background(), "JunkServer.Handler2", 111, &reply); err != ErrUnreachable {
+			t.Fatalf("disabled end: %v; expected ErrUnreachable", err)
+		}
+	}
+
+	rn.Enable("end1-99", true)
+
+	{
+		reply := ""
+		if err := e.CallContext(context.Background(), "JunkServer.Handler2", 111, &reply); err != nil || reply != "handler2-111" {
+			t.Fatalf("wrong reply from Handler2: %v %q", err, reply)
+		}
+	}
+
+	{
+		// Handler2 replies with a string
+		reply := 0
+		if err := e.CallContext(context.Background(), "JunkServer.Handler2", 111, &reply); !errors.Is(err, ErrDecode) {
+			t.Fatalf("wrong reply type: %v; expected ErrDecode", err)
+		}
+	}
+
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		t0 := time.Now()
+		reply := 0
+		if err := e.CallContext(ctx, "JunkServer.Handler3", 99, &reply); err != context.DeadlineExceeded {
+			t.Fatalf("Handler3 past the deadline: %v; expected DeadlineExceeded", err)
+		}
+		if d := time.Since(t0); d > time.Second {
+			t.Fatalf("CallContext() took %v to give up", d)
+		}
+	}
+
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		reply := ""
+		if err := e.CallContext(ctx, "JunkServer.Handler2", 111, &reply); err != context.Canceled {
+			t.Fatalf("canceled call: %v; expected Canceled", err)
+		}
+	}
+
+	{
+		errCh := make(chan error)
+		go func() {
+			reply := 0
+			errCh <- e.CallContext(context.Background(), "JunkServer.Handler3", 99, &reply)
+		}()
+		time.Sleep(200 * time.Millisecond)
+		rn.DeleteServer("server99")
+		if err := <-errCh; err != ErrServerDead {
+			t.Fatalf("Handler3 after DeleteServer(): %v; expected ErrServerDead", err)
+		}
+	}
+
+	rn.AddServer("server99", rs)
+	rn.Reliable(false)
+	lost := 0
+	for i := 0; i < 100; i++ {
+		// Handler3 holds JunkServer.mu, so call one that doesn't lock it
+		reply := JunkReply{}
+		err := e.CallContext(context.Background(), "JunkServer.Handler4", &JunkArgs{i}, &reply)
+		if err == ErrTimeout {
+			lost++
+		} else if err != nil {
+			t.Fatalf("unreliable call: %v; expected nil or ErrTimeout", err)
+		}
+	}
+	if lost == 0 {
+		t.Fatalf("an unreliable network lost none of 100 calls")
+	}
+}
+
+func TestTCPCallContext(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	l := serveTCP(t, "tcp", "127.0.0.1:0", rs)
+	addr := l.Addr().String()
+
+	e := MakeTCPEnd("tcp", addr, TCPOptions{CallTimeout: 500 * time.Millisecond})
+	defer e.Close()
+
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		reply := 0
+		if err := e.CallContext(ctx, "JunkServer.Handler3", 99, &reply); err != context.DeadlineExceeded {
+			t.Fatalf("Handler3 past the deadline: %v; expected DeadlineExceeded", err)
+		}
+	}
+
+	{
+		reply := 0
+		if err := e.CallContext(context.Background(), "JunkServer.Handler3", 99, &reply); err != ErrTimeout {
+			t.Fatalf("Handler3 past CallTimeout: %v; expected ErrTimeout", err)
+		}
+	}
+
+	{
+		// Handler3 holds JunkServer.mu, so call one that doesn't lock it
+		reply := JunkReply{}
+		if err := e.CallContext(context.Background(), "JunkServer.Handler4", &JunkArgs{}, &reply); err != nil || reply.X != "pointer" {
+			t.Fatalf("wrong reply from Handler4: %v %q", err, reply.X)
+		}
+	}
+
+	l.Close()
+	time.Sleep(100 * time.Millisecond)
+	{
+		// the first call may go out on the idle connection, which the server closed
+		reply := JunkReply{}
+		if err := e.CallContext(context.Background(), "JunkServer.Handler4", &JunkArgs{}, &reply); err != ErrServerDead && err != ErrUnreachable {
+			t.Fatalf("server gone: %v; expected ErrServerDead or ErrUnreachable", err)
+		}
+		if err := e.CallContext(context.Background(), "JunkServer.Handler4", &JunkArgs{}, &reply); err != ErrUnreachable {
+			t.Fatalf("no server: %v; expected ErrUnreachable", err)
+		}
+	}
+}
+
+//
+// do Partition(), CutLink() and Heal() decide who reaches whom?
+//
+func TestPartition(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	// three servers, each with an end to each of the others.
+	names := []interface{}{"s0", "s1", "s2"}
+	ends := map[[2]interface{}]*ClientEnd{}
+	for _, to := range names {
+		rs := MakeServer()
+		rs.AddService(MakeService(&JunkServer{}))
+		rn.AddServer(to, rs)
+		for _, from := range names {
+			endname := fmt.Sprintf("%v-%v", from, to)
+			ends[[2]interface{}{from, to}] = rn.MakeEnd(endname)
+			rn.Connect(endname, to)
+			rn.Enable(endname, true)
+			rn.SetHost(endname, from)
+		}
+	}
+	call := func(from, to string) error {
+		reply := JunkReply{}
+		return ends[[2]interface{}{from, to}].CallContext(context.Background(), "JunkServer.Handler4", &JunkArgs{}, &reply)
+	}
+	check := func(from, to string, expected error) {
+		if err := call(from, to); err != expected {
+			t.Fatalf("%v -> %v: %v; expected %v", from, to, err, expected)
+		}
+	}
+
+	// s1 bridges the two groups.
+	rn.Partition([]interface{}{"s0", "s1"}, []interface{}{"s1", "s2"})
+	check("s0", "s1", nil)
+	check("s1", "s0", nil)
+	check("s1", "s2", nil)
+	check("s2", "s1", nil)
+	check("s0", "s2", ErrUnreachable)
+	check("s2", "s0", ErrUnreachable)
+
+	// s0's messages to s1 are lost, including the replies to s1's requests.
+	rn.Heal()
+	rn.CutLink("s0", "s1")
+	check("s0", "s1", ErrUnreachable)
+	n := rn.GetCount("s0")
+	check("s1", "s0", ErrTimeout)
+	if rn.GetCount("s0") != n+1 {
+		t.Fatalf("s1's request didn't reach s0")
+	}
+	check("s0", "s2", nil)
+
+	rn.Heal()
+	for _, from := range names {
+		for _, to := range names {
+			check(from.(string), to.(string), nil)
+		}
+	}
+}
+
+//
+// do a link's latency, loss, duplication and bandwidth take effect?
+//
+func TestLinkPolicy(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+	rn.SetHost("end1-99", "server1")
+
+	// a reply of n bytes.
+	call := func(n int) (error, time.Duration) {
+		t0 := time.Now()
+		reply := ""
+		err := e.CallContext(context.Background(), "JunkServer.Handler7", n, &reply)
+		return err, time.Since(t0)
+	}
+
+	// latency, each way.
+	rn.SetLinkPolicy("server1", "server99", LinkPolicy{Latency: 50 * time.Millisecond, Jitter: 20 * time.Millisecond})
+	if err, d := call(10); err != nil || d < 100*time.Millisecond || d > 300*time.Millisecond {
+		t.Fatalf("call over a 50ms link: %v after %v", err, d)
+	}
+
+	// bandwidth: 10000 bytes of reply at 20000 bytes/second.
+	rn.SetLinkPolicy("server1", "server99", LinkPolicy{Bandwidth: 20000})
+	if err, d := call(10000); err != nil || d < 500*time.Millisecond || d > 1200*time.Millisecond {
+		t.Fatalf("call over a 20000 bytes/second link: %v after %v", err, d)
+	}
+
+	// loss.
+	rn.SetLinkPolicy("server1", "server99", LinkPolicy{DropRate: 1})
+	if err, _ := call(10); err != ErrTimeout {
+		t.Fatalf("call over a link that loses everything: %v", err)
+	}
+
+	// duplication.
+	rn.SetLinkPolicy("server1", "server99", LinkPolicy{DupRate: 1})
+	n := rn.GetCount("server99")
+	if err, _ := call(10); err != nil {
+		t.Fatalf("call over a duplicating link: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := rn.GetCount("server99") - n; got != 2 {
+		t.Fatalf("a duplicating link delivered the request %v times; expected 2", got)
+	}
+
+	// back to the network's own behaviour.
+	rn.DeleteLinkPolicy("server1", "server99")
+	if err, d := call(10); err != nil || d > 50*time.Millisecond {
+		t.Fatalf("call without a link policy: %v after %v", err, d)
+	}
+}
+
+//
+// does Duplicate() deliver requests twice, and StaleReplies() return
+// the late copy's reply?
+//
+func TestDuplicate(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	rn.Duplicate(1)
+	{
+		reply := 0
+		if ok := e.Call("JunkServer.Handler8", 1, &reply); !ok || reply != 1 {
+			t.Fatalf("wrong reply from Handler8: %v %v; expected 1", ok, reply)
+		}
+	}
+	time.Sleep(maxRedeliveryDelay*time.Millisecond + 100*time.Millisecond)
+	if n := rs.GetCount(); n != 2 {
+		t.Fatalf("request delivered %v times; expected 2", n)
+	}
+
+	rn.StaleReplies(1)
+	{
+		reply := 0
+		if ok := e.Call("JunkServer.Handler8", 2, &reply); !ok || reply != 4 {
+			t.Fatalf("wrong reply from Handler8: %v %v; expected the late copy's 4", ok, reply)
+		}
+	}
+
+	rn.Duplicate(0)
+	{
+		reply := 0
+		if ok := e.Call("JunkServer.Handler8", 3, &reply); !ok || reply != 5 {
+			t.Fatalf("wrong reply from Handler8: %v %v; expected 5", ok, reply)
+		}
+	}
+	if n := rs.GetCount(); n != 5 {
+		t.Fatalf("%v requests delivered; expected 5", n)
+	}
+}
+
+// in a simulation, a seed always runs the same way.
+func TestSimNetwork(t *testing.T) {
+	run := func(seed int64) string {
+		s := labsim.New(seed)
+		out := ""
+		s.Run(func() {
+			rn := MakeSimNetwork(s)
+			defer rn.Cleanup()
+			rn.Reliable(false)
+			rn.LongReordering(true)
+			rn.Duplicate(0.2)
+			rn.SetLinkPolicy("c2", "s", LinkPolicy{Latency: 10 * time.Millisecond, Jitter: 5 * time.Millisecond})
+
+			js := &JunkServer{}
+			rs := MakeServer()
+			rs.AddService(MakeService(js))
+			rn.AddServer("s", rs)
+
+			var mu sync.Mutex
+			done := make(chan bool, 30)
+			for c := 0; c < 3; c++ {
+				name := "c" + strconv.Itoa(c)
+				e := rn.MakeEnd(name)
+				rn.Connect(name, "s")
+				rn.Enable(name, true)
+				rn.SetHost(name, name)
+				for i := 0; i < 10; i++ {
+					x := c*100 + i
+					s.Go(func() {
+						reply := ""
+						ok := e.Call("JunkServer.Handler2", x, &reply)
+						mu.Lock()
+						out += fmt.Sprintf("%d:%v@%v ", x, ok, s.Now().UnixMilli())
+						mu.Unlock()
+						labsim.Send(s, done, true)
+					})
+				}
+			}
+			for i := 0; i < 30; i++ {
+				labsim.Recv(s, done)
+			}
+
+			js.mu.Lock()
+			defer js.mu.Unlock()
+			out += fmt.Sprint(js.log2, rn.GetTotalCount(), rn.GetTotalBytes(), s.Now().UnixMilli())
+		})
+		return out
+	}
+
+	if a, b := run(1), run(1); a != b {
+		t.Fatalf("seed 1 ran two ways:\n%v\n%v", a, b)
+	}
+	if run(1) == run(2) {
+		t.Fatalf("seeds 1 and 2 ran the same way")
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	// a file, on a real network
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("s", rs)
+	e := rn.MakeEnd("e")
+	rn.Connect("e", "s")
+	rn.Enable("e", true)
+
+	path := filepath.Join(t.TempDir(), "trace")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rn.StartRecording(f)
+	for i := 0; i < 5; i++ {
+		reply := 0
+		e.Call("JunkServer.Handler8", i, &reply)
+	}
+	rn.Enable("e", false)
+	e.Call("JunkServer.Handler8", 5, new(int))
+	if err := rn.StopRecording(); err != nil {
+		t.Fatal(err)
+	}
+	e.Call("JunkServer.Handler8", 6, new(int)) // not recorded
+	f.Close()
+
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := ReadRecords(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 6 {
+		t.Fatalf("%v records, expected 6", len(records))
+	}
+	for i, rec := range records {
+		if rec.Seq != i+1 || rec.End != "e" || rec.SvcMeth != "JunkServer.Handler8" {
+			t.Fatalf("wrong record %+v", rec)
+		}
+		if i < 5 && (rec.Decision != Delivered || rec.Server != "s" || len(rec.Runs) != 1 || !rec.Runs[0].OK) {
+			t.Fatalf("wrong record of a delivered call %+v", rec)
+		}
+	}
+	if records[5].Decision != Unreachable || len(records[5].Runs) != 0 {
+		t.Fatalf("wrong record of an undelivered call %+v", records[5])
+	}
+
+	// a fresh server replies the same way to the same calls
+	rs1 := MakeServer()
+	rs1.AddService(MakeService(&JunkServer{}))
+	if n, err := Replay(rs1, "s", records); n != 5 || err != nil {
+		t.Fatalf("Replay() = %v, %v", n, err)
+	}
+	// but a server that has seen a call already doesn't
+	var rerr *ReplayError
+	if n, err := Replay(rs1, "s", records); n != 0 || !errors.As(err, &rerr) || rerr.Seq != 1 {
+		t.Fatalf("Replay() = %v, %v", n, err)
+	}
+
+	// a simulated, unreliable network that duplicates requests
+	s := labsim.New(1)
+	var buf bytes.Buffer
+	js = &JunkServer{}
+	s.Run(func() {
+		rn := MakeSimNetwork(s)
+		defer rn.Cleanup()
+		rn.Reliable(false)
+		rn.LongReordering(true)
+		rn.Duplicate(0.3)
+		rs := MakeServer()
+		rs.AddService(MakeService(js))
+		rn.AddServer("s", rs)
+		rn.StartRecording(&buf)
+
+		done := make(chan bool, 20)
+		for c := 0; c < 4; c++ {
+			e := rn.MakeEnd(c)
+			rn.Connect(c, "s")
+			rn.Enable(c, true)
+			for i := 0; i < 5; i++ {
+				x := c*10 + i
+				s.Go(func() {
+					labsim.Send(s, done, e.Call("JunkServer.Handler8", x, new(int)))
+				})
+			}
+		}
+		for i := 0; i < 20; i++ {
+			labsim.Recv(s, done)
+		}
+		s.Sleep(2 * maxRedeliveryDelay * time.Millisecond) // for the late copies
+		if err := rn.StopRecording(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	records, err = ReadRecords(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := 0
+	decisions := map[Decision]int{}
+	for _, rec := range records {
+		runs += len(rec.Runs)
+		decisions[rec.Decision]++
+		if rec.Duplicated && rec.Decision != RequestLost && len(rec.Runs) != 2 {
+			t.Fatalf("duplicated request ran %v times", len(rec.Runs))
+		}
+	}
+	if len(records) != 20 || runs != len(js.log2) {
+		t.Fatalf("%v records with %v runs, expected 20 with %v", len(records), runs, len(js.log2))
+	}
+	if decisions[Delivered] == 0 || decisions[ReplyDelayed] == 0 || decisions[RequestLost]+decisions[ReplyLost] == 0 {
+		t.Fatalf("unlikely decisions %v", decisions)
+	}
+	rs1 = MakeServer()
+	rs1.AddService(MakeService(&JunkServer{}))
+	if n, err := Replay(rs1, "s", records); n != runs || err != nil {
+		t.Fatalf("Replay() = %v, %v; expected %v", n, err, runs)
+	}
+}
+
+func TestIntercept(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+
+	// the server loses Handler1 calls, and adds to Handler2 replies.
+	var mu sync.Mutex
+	seen := []string{}
+	rs.Intercept(func(from interface{}, svcMeth string, args, reply interface{}, handle Handler) error {
+		mu.Lock()
+		seen = append(seen, fmt.Sprintf("%v %v %v", from, svcMeth, args))
+		mu.Unlock()
+		if svcMeth == "JunkServer.Handler1" {
+			return errors.New("no Handler1")
+		}
+		return handle(args, reply)
+	}, func(from interface{}, svcMeth string, args, reply interface{}, handle Handler) error {
+		err := handle(args, reply)
+		if s, ok := reply.(*string); ok {
+			*s += "!"
+		}
+		return err
+	})
+
+	// the client doubles the args of Handler2, and times out Handler6
+	// without sending it.
+	order := ""
+	intercept := func(e *ClientEnd) {
+		e.Intercept(func(ctx context.Context, svcMeth string, args, reply interface{}, invoke Invoker) error {
+			order += "a"
+			if svcMeth == "JunkServer.Handler2" {
+				args = 2 * args.(int)
+			}
+			return invoke(ctx, svcMeth, args, reply)
+		})
+		e.Intercept(func(ctx context.Context, svcMeth string, args, reply interface{}, invoke Invoker) error {
+			order += "b"
+			if svcMeth == "JunkServer.Handler6" {
+				return ErrTimeout
+			}
+			return invoke(ctx, svcMeth, args, reply)
+		})
+	}
+
+	check := func(e *ClientEnd, from string) {
+		order = ""
+		seen = nil
+		reply := ""
+		if err := e.CallContext(context.Background(), "JunkServer.Handler2", 111, &reply); err != nil || reply != "handler2-222!" {
+			t.Fatalf("wrong reply from Handler2: %v %q", err, reply)
+		}
+		n := 0
+		err := e.CallContext(context.Background(), "JunkServer.Handler1", "9099", &n)
+		var re *RejectedError
+		if !errors.Is(err, ErrRejected) || !errors.As(err, &re) || re.Why != "no Handler1" {
+			t.Fatalf("Handler1 got error %v, expected it rejected", err)
+		}
+		if ok := e.Call("JunkServer.Handler6", "x", &n); ok {
+			t.Fatalf("Handler6 wasn't stopped")
+		}
+		if order != "ababab" {
+			t.Fatalf("the client interceptors ran in order %q", order)
+		}
+		if fmt.Sprint(seen) != fmt.Sprintf("[%v JunkServer.Handler2 222 %v JunkServer.Handler1 9099]", from, from) {
+			t.Fatalf("the server interceptor saw %v", seen)
+		}
+		if len(js.log1) != 0 {
+			t.Fatalf("Handler1 ran")
+		}
+	}
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+	rn.AddServer("s", rs)
+	e := rn.MakeEnd("e")
+	rn.Connect("e", "s")
+	rn.Enable("e", true)
+	intercept(e)
+	check(e, "e")
+
+	l := serveTCP(t, "tcp", "127.0.0.1:0", rs)
+	defer l.Close()
+	te := MakeTCPEnd("tcp", l.Addr().String(), TCPOptions{})
+	defer te.Close()
+	intercept(te)
+	seen = nil
+	reply := ""
+	te.Call("JunkServer.Handler2", 1, &reply) // to learn the end's address
+	check(te, seen[0][:strings.Index(seen[0], " ")])
+}
+
+// a call the server can't dispatch, or whose reply the caller can't
+// decode, fails with an error, and the server goes on.
+func TestDispatchErrors(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+
+	check := func(e *ClientEnd) {
+		for _, c := range []struct {
+			svcMeth string
+			args    interface{}
+			want    error
+		}{
+			{"Nope.Handler2", 1, ErrUnknownService},
+			{"JunkServer.Nope", 1, ErrUnknownMethod},
+			{"Handler2", 1, ErrUnknownMethod},
+			{"JunkServer.Handler2", "x", ErrBadArgs},
+		} {
+			reply := ""
+			err := e.CallContext(context.Background(), c.svcMeth, c.args, &reply)
+			var de *DispatchError
+			if !errors.Is(err, c.want) || !errors.As(err, &de) || de.SvcMeth != c.svcMeth {
+				t.Fatalf("%v(%v) got error %v, expected %v", c.svcMeth, c.args, err, c.want)
+			}
+		}
+
+		err := e.CallContext(context.Background(), "Nope.Handler2", 1, new(string))
+		if !strings.Contains(err.Error(), "[JunkServer]") {
+			t.Fatalf("the error %q doesn't say which services there are", err)
+		}
+
+		n := 0
+		if err := e.CallContext(context.Background(), "JunkServer.Handler2", 1, &n); !errors.Is(err, ErrDecode) {
+			t.Fatalf("decoding a string reply into an int got error %v", err)
+		}
+		if ok := e.Call("JunkServer.Handler2", 1, &n); ok {
+			t.Fatalf("Call() succeeded with a reply it can't decode")
+		}
+
+		reply := ""
+		if ok := e.Call("JunkServer.Handler2", 111, &reply); !ok || reply != "handler2-111" {
+			t.Fatalf("wrong reply from Handler2: %v %q", ok, reply)
+		}
+	}
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+	rn.AddServer("s", rs)
+	e := rn.MakeEnd("e")
+	rn.Connect("e", "s")
+	rn.Enable("e", true)
+	check(e)
+
+	l := serveTCP(t, "tcp", "127.0.0.1:0", rs)
+	defer l.Close()
+	te := MakeTCPEnd("tcp", l.Addr().String(), TCPOptions{})
+	defer te.Close()
+	check(te)
+}
+
+func TestStats(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("s", rs)
+	rn.AddServer("h", MakeServer())
+
+	e := rn.MakeEnd("e")
+	rn.Connect("e", "s")
+	rn.Enable("e", true)
+	rn.SetHost("e", "h")
+	e2 := rn.MakeEnd("e2")
+	rn.Connect("e2", "s")
+
+	for i := 0; i < 10; i++ {
+		reply := ""
+		e.Call("JunkServer.Handler7", 100, &reply)
+	}
+	for i := 0; i < 5; i++ {
+		n := 0
+		e.Call("JunkServer.Handler6", "xyz", &n)
+		e2.Call("JunkServer.Handler6", "xyz", &n) // disabled
+	}
+	e.Call("JunkServer.Nope", 0, new(int))
+
+	st := rn.Stats()
+	h7 := st.Methods["JunkServer.Handler7"]
+	if h7.Calls != 10 || h7.Drops != 0 || h7.Errors != 0 || h7.Latency.Count() != 10 {
+		t.Fatalf("wrong Handler7 stats %v", h7)
+	}
+	if h7.BytesIn < 10*100 || h7.BytesOut >= h7.BytesIn {
+		t.Fatalf("wrong Handler7 bytes %v out, %v in", h7.BytesOut, h7.BytesIn)
+	}
+	if h6 := st.Methods["JunkServer.Handler6"]; h6.Calls != 10 || h6.Drops != 5 || h6.Latency.Count() != 5 {
+		t.Fatalf("wrong Handler6 stats %v", h6)
+	}
+	if nope := st.Methods["JunkServer.Nope"]; nope.Calls != 1 || nope.Errors != 1 {
+		t.Fatalf("wrong stats %v for an unknown method", nope)
+	}
+	if l := st.Links[[2]interface{}{"h", "s"}]; l.Calls != 16 || l.Drops != 0 {
+		t.Fatalf("wrong stats %v for the link from h to s", l)
+	}
+	if l := st.Links[[2]interface{}{"e2", "s"}]; l.Calls != 5 || l.Drops != 5 {
+		t.Fatalf("wrong stats %v for the link from e2 to s", l)
+	}
+
+	sst := rs.Stats()
+	if s := sst["JunkServer.Handler7"]; s.Calls != 10 || s.BytesOut != h7.BytesIn || s.BytesIn != h7.BytesOut {
+		t.Fatalf("wrong server Handler7 stats %v", s)
+	}
+	if s := sst["JunkServer.Handler6"]; s.Calls != 5 {
+		t.Fatalf("wrong server Handler6 stats %v", s)
+	}
+
+	rn.ResetStats()
+	if st := rn.Stats(); len(st.Methods) != 0 || len(st.Links) != 0 {
+		t.Fatalf("ResetStats() left %v", st)
+	}
+
+	var h Histogram
+	for i := 1; i <= 100; i++ {
+		h.Add(time.Duration(i) * time.Millisecond)
+	}
+	if h.Count() != 100 || h.Max != 100*time.Millisecond || h.Mean() != 50500*time.Microsecond {
+		t.Fatalf("wrong histogram %v", h)
+	}
+	if q := h.Quantile(0.4); q != 50*time.Millisecond {
+		t.Fatalf("Quantile(0.4) = %v, expected 50ms", q)
+	}
+	if q := h.Quantile(0.99); q != 100*time.Millisecond {
+		t.Fatalf("Quantile(0.99) = %v, expected 100ms", q)
+	}
+}
+
+// keeps track of how many calls run at once.
+type StreamServer struct {
+	mu      sync.Mutex
+	running int
+	max     int
+	got     []int
+}
+
+func (ss *StreamServer) Chunk(args int, reply *int) {
+	ss.mu.Lock()
+	ss.running++
+	if ss.running > ss.max {
+		ss.max = ss.running
+	}
+	ss.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.running--
+	ss.got = append(ss.got, args)
+	*reply = args * 2
+}
+
+// each link counts its own calls, and what a cut or a policy does to them.
+func TestLinkStats(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	for _, name := range []string{"a", "b", "c"} {
+		rs := MakeServer()
+		rs.AddService(MakeService(&JunkServer{}))
+		rn.AddServer(name, rs)
+	}
+	ea := rn.MakeEnd("ea")
+	rn.Connect("ea", "b")
+	rn.Enable("ea", true)
+	rn.SetHost("ea", "a")
+	ec := rn.MakeEnd("ec")
+	rn.Connect("ec", "c")
+	rn.Enable("ec", true)
+	rn.SetHost("ec", "a")
+
+	rn.CutLink("a", "b")
+	for i := 0; i < 4; i++ {
+		reply := ""
+		if ea.Call("JunkServer.Handler2", i, &reply) {
+			t.Fatalf("a call over a cut link succeeded")
+		}
+	}
+	for i := 0; i < 3; i++ {
+		reply := ""
+		if !ec.Call("JunkServer.Handler2", i, &reply) {
+			t.Fatalf("a call over another link failed")
+		}
+	}
+	if l := rn.LinkStats("a", "b"); l.Calls != 4 || l.Drops != 4 {
+		t.Fatalf("wrong stats %v for the cut link", l)
+	}
+	if l := rn.LinkStats("a", "c"); l.Calls != 3 || l.Drops != 0 {
+		t.Fatalf("wrong stats %v for the other link", l)
+	}
+
+	rn.Heal()
+	rn.SetLinkPolicy("a", "b", LinkPolicy{DupRate: 1})
+	for i := 0; i < 2; i++ {
+		reply := ""
+		ea.Call("JunkServer.Handler2", i, &reply)
+	}
+	rn.SetLinkPolicy("a", "b", LinkPolicy{DropRate: 1})
+	for i := 0; i < 3; i++ {
+		reply := ""
+		ea.Call("JunkServer.Handler2", i, &reply)
+	}
+	if l := rn.LinkStats("a", "b"); l.Calls != 9 || l.Drops != 7 || l.Dups != 2 {
+		t.Fatalf("wrong stats %v for the link with a policy", l)
+	}
+	if l := rn.LinkStats("a", "c"); l.Calls != 3 || l.Dups != 0 {
+		t.Fatalf("wrong stats %v for the other link", l)
+	}
+}
+
+func TestGo(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("s", rs)
+	e := rn.MakeEnd("e")
+	rn.Connect("e", "s")
+	rn.Enable("e", true)
+
+	// many calls, one done channel
+	done := make(chan *AsyncCall, 10)
+	replies := make([]string, 20)
+	for i := 0; i < 20; i++ {
+		e.Go("JunkServer.Handler2", i, &replies[i], done)
+	}
+	for i := 0; i < 20; i++ {
+		c := <-done
+		if c.Error != nil || c.SvcMeth != "JunkServer.Handler2" || *c.Reply.(*string) != "handler2-"+strconv.Itoa(c.Args.(int)) {
+			t.Fatalf("wrong call %v %v %v", c.Error, c.Args, c.Reply)
+		}
+	}
+
+	// a channel of its own, and an error
+	n := 0
+	c := e.Go("JunkServer.Nope", 1, &n, nil)
+	if c = <-c.Done; !errors.Is(c.Error, ErrUnknownMethod) {
+		t.Fatalf("got error %v, expected ErrUnknownMethod", c.Error)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("no panic for an unbuffered done channel")
+		}
+	}()
+	e.Go("JunkServer.Handler2", 1, new(string), make(chan *AsyncCall))
+}
+
+func TestStream(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	ss := &StreamServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(ss))
+	rn.AddServer("s", rs)
+	e := rn.MakeEnd("e")
+	rn.Connect("e", "s")
+	rn.Enable("e", true)
+
+	st := e.OpenStream(context.Background(), "StreamServer.Chunk", 3)
+	replies := make([]int, 30)
+	for i := range replies {
+		if err := st.Send(i, &replies[i]); err != nil {
+			t.Fatalf("Send(): %v", err)
+		}
+	}
+	if err := st.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+	for i, r := range replies {
+		if r != 2*i {
+			t.Fatalf("wrong reply %v to chunk %v", r, i)
+		}
+	}
+	if len(ss.got) != 30 || ss.max > 3 || ss.max < 2 {
+		t.Fatalf("got %v chunks, at most %v at once; expected 30, 3 at once", len(ss.got), ss.max)
+	}
+
+	// a window of 1 keeps the calls in order
+	ss.got = nil
+	st = e.OpenStream(context.Background(), "StreamServer.Chunk", 1)
+	for i := 0; i < 10; i++ {
+		st.Send(i, new(int))
+	}
+	if err := st.Close(); err != nil || fmt.Sprint(ss.got) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Fatalf("Close() = %v, the server got %v", err, ss.got)
+	}
+
+	// the stream stops at the first failure
+	rn.Enable("e", false)
+	st = e.OpenStream(context.Background(), "StreamServer.Chunk", 2)
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = st.Send(i, new(int))
+	}
+	if !errors.Is(err, ErrUnreachable) || !errors.Is(st.Close(), ErrUnreachable) {
+		t.Fatalf("Send() = %v, Close() = %v; expected ErrUnreachable", err, st.Close())
+	}
+}
+
+// simStream makes async calls and streams them over an unreliable
+// simulated network, and returns the order the server got them in.
+func simStream(seed int64) string {
+	s := labsim.New(seed)
+	out := ""
+	s.Run(func() {
+		rn := MakeSimNetwork(s)
+		defer rn.Cleanup()
+		rn.Reliable(false)
+
+		js := &JunkServer{}
+		rs := MakeServer()
+		rs.AddService(MakeService(js))
+		rn.AddServer("s", rs)
+		e := rn.MakeEnd("e")
+		rn.Connect("e", "s")
+		rn.Enable("e", true)
+
+		done := make(chan *AsyncCall, 5)
+		for i := 0; i < 5; i++ {
+			e.Go("JunkServer.Handler8", i, new(int), done)
+		}
+		for i := 0; i < 5; i++ {
+			c, _ := labsim.Recv(s, done)
+			out += fmt.Sprintf("%v:%v ", c.Args, c.Error == nil)
+		}
+
+		st := e.OpenStream(context.Background(), "JunkServer.Handler8", 2)
+		for i := 100; i < 120; i++ {
+			if err := st.Send(i, new(int)); err != nil {
+				break
+			}
+		}
+		out += fmt.Sprintf("%v %v", st.Close(), js.log2)
+	})
+	return out
+}
+
+func TestSimStream(t *testing.T) {
+	for seed := int64(0); seed < 5; seed++ {
+		if a, b := simStream(seed), simStream(seed); a != b {
+			t.Fatalf("seed %d ran two ways:\n%v\n%v", seed, a, b)
+		}
+	}
+}
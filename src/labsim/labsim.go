@@ -0,0 +1,487 @@
+package labsim
+
+//
+// deterministic simulation, to run labrpc and Raft on a virtual clock
+// so that a test that fails for some seed fails the same way every time
+// it is run with that seed.
+//
+// s := labsim.New(seed) -- a simulation, with its random numbers drawn
+//   from seed.
+// s.Run(f) -- run f on the calling goroutine, as the first task of the
+//   simulation, and return when f does.
+// s.Go(f) -- run f in a new task.
+// s.Now(), s.Since(t), s.Sleep(d), s.After(d), s.AfterFunc(d, f) -- the
+//   virtual clock.
+// s.Int63(), s.Intn(n), s.Float64(), ... -- the seeded random numbers.
+// labsim.NewCond(s, l) -- a condition variable that tasks can wait on.
+// labsim.Send(s, ch, v), labsim.Recv(s, ch), labsim.RecvOr(s, ch, stop)
+//   -- channel operations that tasks can block in.
+//
+// all of these work on a nil *Sim too, and then do what a goroutine, the
+// time and math/rand packages, a sync.Cond or a channel operation would.
+// code that holds a *Sim thus runs for real when it is nil, and
+// simulated when it isn't.
+//
+// one task runs at a time. it runs until it blocks in one of the above,
+// or ends; then the simulation picks the next task to run, at random from
+// the seed, among those that can. when none can, the clock jumps to the
+// next timer. nothing depends on real time or on the Go scheduler, so a
+// seed replays the same interleaving every time.
+//
+// that only holds if the simulated code plays by these rules:
+// - every goroutine is started by s.Go() (or s.AfterFunc()).
+// - a task only blocks through the Sim: no time.Sleep(), sync.Cond, or
+//   channel operation that can block. it may take a sync.Mutex, as long
+//   as no task blocks while it holds one.
+// - the channels that tasks Send() and Recv() values over are buffered.
+//   the Sim polls them, and two pollers never meet on an unbuffered one.
+// - nothing depends on the order of map iteration, or on the time of day.
+//
+// the tasks still blocked when Run() returns stay blocked for good.
+//
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// the virtual clock starts at epoch.
+var epoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type Sim struct {
+	mu      sync.Mutex
+	rng     *rand.Rand
+	now     time.Time
+	seq     int64     // orders timers due at the same time
+	timers  timerHeap // pending Sleep()s and AfterFunc()s
+	runq    []*task   // tasks that can run
+	polling []*task   // tasks waiting for a condition they poll, see waitUntil()
+	running *task
+	stopped bool // Run() has returned
+}
+
+type task struct {
+	wake  chan struct{}
+	retry bool // woken from polling, and hasn't done anything else since
+}
+
+// how a task stops running.
+type parking int
+
+const (
+	yielding parking = iota // it can go on right away
+	polling                 // its condition is false; it'll check again later
+	blocked                 // until a timer or a Cond wakes it
+	exiting
+)
+
+func New(seed int64) *Sim {
+	return &Sim{rng: rand.New(rand.NewSource(seed)), now: epoch}
+}
+
+// Run runs f as the first task, on the calling goroutine, so f may call
+// t.Fatalf() and the like. the simulation is over when f returns.
+func (s *Sim) Run(f func()) {
+	s.mu.Lock()
+	if s.running != nil || s.stopped {
+		s.mu.Unlock()
+		panic("labsim: Run() called twice")
+	}
+	s.running = newTask()
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.stopped = true
+		s.running = nil
+	}()
+	f()
+}
+
+func newTask() *task {
+	return &task{wake: make(chan struct{}, 1)}
+}
+
+// Go runs f in a new task.
+func (s *Sim) Go(f func()) {
+	if s == nil {
+		go f()
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spawn(f)
+}
+
+// called with s.mu held.
+func (s *Sim) spawn(f func()) {
+	if s.stopped {
+		return
+	}
+	t := newTask()
+	s.runq = append(s.runq, t)
+	go func() {
+		<-t.wake
+		defer func() {
+			s.mu.Lock()
+			s.park(exiting)
+		}()
+		f()
+	}()
+}
+
+// park stops the running task, and runs the next one. it returns when the
+// task is picked to run again. called with s.mu held, which it releases.
+func (s *Sim) park(how parking) {
+	t := s.running
+	if t == nil {
+		s.mu.Unlock()
+		panic("labsim: blocking outside a task")
+	}
+	switch how {
+	case yielding:
+		s.runq = append(s.runq, t)
+		s.progress()
+	case polling:
+		if !t.retry {
+			// t did something since it last polled, which may be what
+			// another poller is waiting for
+			s.progress()
+		}
+		s.polling = append(s.polling, t)
+	case blocked, exiting:
+		// if blocked, the caller has arranged for t to be woken
+		s.progress()
+	}
+
+	next := s.next()
+	s.running = next
+	s.mu.Unlock()
+	if next == t {
+		return
+	}
+	next.wake <- struct{}{}
+	if how != exiting {
+		<-t.wake
+	}
+}
+
+// progress gives the pollers another chance. called with s.mu held.
+func (s *Sim) progress() {
+	for _, t := range s.polling {
+		t.retry = true
+		s.runq = append(s.runq, t)
+	}
+	s.polling = nil
+}
+
+// next takes the task to run next off the run queue, running the clock
+// forward until there is one. called with s.mu held.
+func (s *Sim) next() *task {
+	for len(s.runq) == 0 {
+		if len(s.timers) == 0 {
+			s.mu.Unlock()
+			panic("labsim: deadlock: every task is blocked")
+		}
+		tm := heap.Pop(&s.timers).(*timer)
+		if tm.at.After(s.now) {
+			s.now = tm.at
+		}
+		if tm.t != nil {
+			s.runq = append(s.runq, tm.t)
+		} else {
+			s.spawn(tm.f)
+		}
+	}
+
+	n := len(s.runq)
+	i := s.rng.Intn(n)
+	t := s.runq[i]
+	copy(s.runq[i:], s.runq[i+1:])
+	s.runq = s.runq[:n-1]
+	return t
+}
+
+// waitUntil blocks the running task until cond() holds. the Sim can't
+// tell when that might be, so it calls cond() again whenever another task
+// has done something, until it holds.
+func (s *Sim) waitUntil(cond func() bool) {
+	for !cond() {
+		s.mu.Lock()
+		s.park(polling)
+	}
+	s.mu.Lock()
+	if s.running != nil {
+		s.running.retry = false
+	}
+	s.mu.Unlock()
+}
+
+//
+// the clock.
+//
+
+type timer struct {
+	at  time.Time
+	seq int64
+	t   *task  // to wake up, or
+	f   func() // to run in a new task
+}
+
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h timerHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *timerHeap) Push(x interface{}) { *h = append(*h, x.(*timer)) }
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	tm := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return tm
+}
+
+// called with s.mu held.
+func (s *Sim) addTimer(d time.Duration, t *task, f func()) {
+	if d < 0 {
+		d = 0
+	}
+	s.seq++
+	heap.Push(&s.timers, &timer{s.now.Add(d), s.seq, t, f})
+}
+
+func (s *Sim) Now() time.Time {
+	if s == nil {
+		return time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+func (s *Sim) Since(t time.Time) time.Duration {
+	return s.Now().Sub(t)
+}
+
+func (s *Sim) Sleep(d time.Duration) {
+	if s == nil {
+		time.Sleep(d)
+		return
+	}
+	s.mu.Lock()
+	if d <= 0 {
+		s.park(yielding)
+		return
+	}
+	s.addTimer(d, s.running, nil)
+	s.park(blocked)
+}
+
+// AfterFunc runs f in a new task once d has passed.
+func (s *Sim) AfterFunc(d time.Duration, f func()) {
+	if s == nil {
+		time.AfterFunc(d, f)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addTimer(d, nil, f)
+}
+
+// After returns a channel that is closed once d has passed.
+func (s *Sim) After(d time.Duration) <-chan struct{} {
+	ch := make(chan struct{})
+	s.AfterFunc(d, func() { close(ch) })
+	return ch
+}
+
+//
+// random numbers; without a Sim, from math/rand's global source.
+//
+
+func (s *Sim) Int() int {
+	if s == nil {
+		return rand.Int()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Int()
+}
+
+func (s *Sim) Intn(n int) int {
+	if s == nil {
+		return rand.Intn(n)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Intn(n)
+}
+
+func (s *Sim) Int63() int64 {
+	if s == nil {
+		return rand.Int63()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Int63()
+}
+
+func (s *Sim) Int63n(n int64) int64 {
+	if s == nil {
+		return rand.Int63n(n)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Int63n(n)
+}
+
+func (s *Sim) Float64() float64 {
+	if s == nil {
+		return rand.Float64()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Float64()
+}
+
+func (s *Sim) NormFloat64() float64 {
+	if s == nil {
+		return rand.NormFloat64()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.NormFloat64()
+}
+
+func (s *Sim) ExpFloat64() float64 {
+	if s == nil {
+		return rand.ExpFloat64()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.ExpFloat64()
+}
+
+//
+// blocking.
+//
+
+// Cond is a sync.Cond that tasks can wait on.
+type Cond struct {
+	L       sync.Locker
+	s       *Sim
+	c       *sync.Cond // without a Sim
+	waiters []*task    // guarded by s.mu
+}
+
+func NewCond(s *Sim, l sync.Locker) *Cond {
+	if s == nil {
+		return &Cond{L: l, c: sync.NewCond(l)}
+	}
+	return &Cond{L: l, s: s}
+}
+
+func (c *Cond) Wait() {
+	if c.s == nil {
+		c.c.Wait()
+		return
+	}
+	c.s.mu.Lock()
+	c.waiters = append(c.waiters, c.s.running)
+	c.L.Unlock()
+	c.s.park(blocked)
+	c.L.Lock()
+}
+
+func (c *Cond) Signal() {
+	if c.s == nil {
+		c.c.Signal()
+		return
+	}
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	if len(c.waiters) > 0 {
+		c.s.runq = append(c.s.runq, c.waiters[0])
+		c.waiters = c.waiters[1:]
+	}
+}
+
+func (c *Cond) Broadcast() {
+	if c.s == nil {
+		c.c.Broadcast()
+		return
+	}
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	c.s.runq = append(c.s.runq, c.waiters...)
+	c.waiters = nil
+}
+
+// Send sends v on ch.
+func Send[T any](s *Sim, ch chan<- T, v T) {
+	if s == nil {
+		ch <- v
+		return
+	}
+	s.waitUntil(func() bool {
+		select {
+		case ch <- v:
+			return true
+		default:
+			return false
+		}
+	})
+}
+
+// Recv receives from ch; ok is false if ch is closed.
+func Recv[T any](s *Sim, ch <-chan T) (v T, ok bool) {
+	if s == nil {
+		v, ok = <-ch
+		return
+	}
+	s.waitUntil(func() bool {
+		select {
+		case v, ok = <-ch:
+			return true
+		default:
+			return false
+		}
+	})
+	return
+}
+
+// RecvOr receives from ch, unless stop is closed (or receives) first;
+// got says whether it received from ch.
+func RecvOr[T any, U any](s *Sim, ch <-chan T, stop <-chan U) (v T, got bool) {
+	if s == nil {
+		select {
+		case v = <-ch:
+			return v, true
+		case <-stop:
+			return v, false
+		}
+	}
+	s.waitUntil(func() bool {
+		select {
+		case v = <-ch:
+			got = true
+			return true
+		default:
+		}
+		select {
+		case <-stop:
+			return true
+		default:
+			return false
+		}
+	})
+	return
+}
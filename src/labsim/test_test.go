@@ -0,0 +1,141 @@
+package labsim
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	s := New(1)
+	s.Run(func() {
+		t0 := s.Now()
+		order := []int{}
+		for _, ms := range []int{30, 10, 20} {
+			ms := ms
+			s.Go(func() {
+				s.Sleep(time.Duration(ms) * time.Millisecond)
+				order = append(order, ms)
+			})
+		}
+		s.Sleep(time.Second)
+		if fmt.Sprint(order) != "[10 20 30]" {
+			t.Fatalf("sleepers woke up in order %v", order)
+		}
+		if d := s.Since(t0); d != time.Second {
+			t.Fatalf("the clock moved %v, expected 1s", d)
+		}
+
+		Recv(s, s.After(0)) // closed once the AfterFunc() task has run
+		ch := make(chan int, 1)
+		s.AfterFunc(5*time.Millisecond, func() { Send(s, ch, 1) })
+		if _, got := RecvOr(s, ch, s.After(time.Millisecond)); got {
+			t.Fatalf("RecvOr() received before the timeout")
+		}
+		if _, got := RecvOr(s, ch, s.After(time.Second)); !got {
+			t.Fatalf("RecvOr() timed out")
+		}
+		if d := s.Since(t0); d != time.Second+5*time.Millisecond {
+			t.Fatalf("the clock moved %v, expected 1.005s", d)
+		}
+	})
+}
+
+// trace runs a few tasks that take turns on a lock, send on a channel,
+// and wait on a Cond, and returns the order in which they did so.
+func trace(seed int64) string {
+	s := New(seed)
+	out := ""
+	s.Run(func() {
+		var mu sync.Mutex
+		cond := NewCond(s, &mu)
+		ch := make(chan int, 1)
+		n := 0
+		for i := 0; i < 5; i++ {
+			i := i
+			s.Go(func() {
+				for j := 0; j < 5; j++ {
+					s.Sleep(time.Duration(s.Intn(3)) * time.Millisecond)
+					mu.Lock()
+					out += fmt.Sprintf("%d.%d ", i, j)
+					n++
+					cond.Broadcast()
+					mu.Unlock()
+					Send(s, ch, i)
+				}
+			})
+		}
+		for k := 0; k < 25; k++ {
+			v, _ := Recv(s, ch)
+			out += fmt.Sprintf("<%d ", v)
+		}
+		mu.Lock()
+		for n < 25 {
+			cond.Wait()
+		}
+		mu.Unlock()
+	})
+	return out
+}
+
+func TestReplay(t *testing.T) {
+	differ := false
+	for seed := int64(0); seed < 10; seed++ {
+		tr := trace(seed)
+		for i := 0; i < 3; i++ {
+			if x := trace(seed); x != tr {
+				t.Fatalf("seed %d ran two ways:\n%v\n%v", seed, tr, x)
+			}
+		}
+		if seed > 0 && tr != trace(seed-1) {
+			differ = true
+		}
+	}
+	if !differ {
+		t.Fatalf("all seeds ran the same way")
+	}
+}
+
+func TestDeadlock(t *testing.T) {
+	s := New(1)
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("no panic")
+		}
+	}()
+	s.Run(func() {
+		Recv(s, make(chan int, 1))
+	})
+}
+
+// without a Sim, everything works for real.
+func TestNil(t *testing.T) {
+	var s *Sim
+	var mu sync.Mutex
+	cond := NewCond(s, &mu)
+	ch := make(chan int)
+	done := false
+	s.Go(func() {
+		Send(s, ch, s.Intn(10))
+		mu.Lock()
+		done = true
+		cond.Broadcast()
+		mu.Unlock()
+	})
+	t0 := s.Now()
+	if v, ok := Recv(s, ch); !ok || v >= 10 {
+		t.Fatalf("Recv() = %v, %v", v, ok)
+	}
+	mu.Lock()
+	for !done {
+		cond.Wait()
+	}
+	mu.Unlock()
+	if _, got := RecvOr(s, ch, s.After(20*time.Millisecond)); got {
+		t.Fatalf("RecvOr() received")
+	}
+	if d := s.Since(t0); d < 20*time.Millisecond {
+		t.Fatalf("RecvOr() returned after %v", d)
+	}
+}
@@ -12,10 +12,16 @@ import (
 	"bytes"
 	"lab4/labgob"
 	"lab4/labrpc"
+	"lab4/labsim"
 	"lab4/logger"
 	"log"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -62,7 +68,7 @@ type config struct {
 	rafts       []*Raft
 	applyErr    []string // from apply channel readers
 	connected   []bool   // whether each server is on the net
-	saved       []*Persister
+	saved       []Storage
 	endnames    [][]string            // the port file names each sends to
 	logs        []map[int]interface{} // copy of each server's committed entries
 	lastApplied []int
@@ -75,11 +81,29 @@ type config struct {
 	maxIndex  int
 	maxIndex0 int
 	logger    *logger.Logger
+	opts      Options // passed to every Raft the tester starts
+	faults    *Faults // if set, every server's Persister injects these
+	faultRand *rand.Rand
+	sim       *labsim.Sim // opts.Sim; nil unless the test runs in a simulation
+	trace     *os.File    // where the RPCs are recorded, if $RAFT_RECORD is set
 }
 
 var ncpu_once sync.Once
 
 func make_config(t *testing.T, n int, unreliable bool, snapshot bool) *config {
+	return make_config_opts(t, n, unreliable, snapshot, Options{})
+}
+
+// like make_config, but every Raft is created with opts. if opts.Sim is
+// set, the network, the Rafts and the tester all run in that simulation;
+// the test has to be inside runSim().
+func make_config_opts(t *testing.T, n int, unreliable bool, snapshot bool, opts Options) *config {
+	return make_config_faults(t, n, unreliable, snapshot, opts, nil)
+}
+
+// like make_config_opts, but if faults is set every server's Persister
+// injects them, each with a seed drawn from faults.Seed.
+func make_config_faults(t *testing.T, n int, unreliable bool, snapshot bool, opts Options, faults *Faults) *config {
 	ncpu_once.Do(func() {
 		if runtime.NumCPU() < 2 {
 			fmt.Printf("warning: only one CPU, which may conceal locking bugs\n")
@@ -89,16 +113,29 @@ func make_config(t *testing.T, n int, unreliable bool, snapshot bool) *config {
 	runtime.GOMAXPROCS(4)
 	cfg := &config{}
 	cfg.t = t
-	cfg.net = labrpc.MakeNetwork()
+	cfg.opts = opts
+	if faults != nil {
+		cfg.faults = faults
+		cfg.faultRand = rand.New(rand.NewSource(faults.Seed))
+	}
+	cfg.sim = opts.Sim
+	if cfg.sim != nil {
+		cfg.net = labrpc.MakeSimNetwork(cfg.sim)
+	} else {
+		cfg.net = labrpc.MakeNetwork()
+	}
+	if dir := os.Getenv("RAFT_RECORD"); dir != "" {
+		cfg.record(dir)
+	}
 	cfg.n = n
 	cfg.applyErr = make([]string, cfg.n)
 	cfg.rafts = make([]*Raft, cfg.n)
 	cfg.connected = make([]bool, cfg.n)
-	cfg.saved = make([]*Persister, cfg.n)
+	cfg.saved = make([]Storage, cfg.n)
 	cfg.endnames = make([][]string, cfg.n)
 	cfg.logs = make([]map[int]interface{}, cfg.n)
 	cfg.lastApplied = make([]int, cfg.n)
-	cfg.start = time.Now()
+	cfg.start = cfg.sim.Now()
 
 	cfg.setunreliable(unreliable)
 
@@ -152,7 +189,7 @@ func (cfg *config) crash1(i int) {
 	if cfg.saved[i] != nil {
 		raftlog := cfg.saved[i].ReadRaftState()
 		snapshot := cfg.saved[i].ReadSnapshot()
-		cfg.saved[i] = &Persister{}
+		cfg.saved[i] = cfg.makePersister()
 		cfg.saved[i].Save(raftlog, snapshot)
 	}
 }
@@ -179,7 +216,7 @@ func (cfg *config) checkLogs(i int, m ApplyMsg) (string, bool) {
 // applier reads message from apply ch and checks that they match the log
 // contents
 func (cfg *config) applier(i int, applyCh chan ApplyMsg) {
-	for m := range applyCh {
+	for m, ok := labsim.Recv(cfg.sim, applyCh); ok; m, ok = labsim.Recv(cfg.sim, applyCh) {
 		if m.CommandValid == false {
 			// ignore other types of ApplyMsg
 		} else {
@@ -237,9 +274,13 @@ func (cfg *config) applierSnap(i int, applyCh chan ApplyMsg) {
 		return // ???
 	}
 
-	for m := range applyCh {
+	for m, ok := labsim.Recv(cfg.sim, applyCh); ok; m, ok = labsim.Recv(cfg.sim, applyCh) {
 		err_msg := ""
-		if m.CommandValid {
+		if m.SnapshotValid {
+			cfg.mu.Lock()
+			err_msg = cfg.ingestSnap(i, m.Snapshot, m.SnapshotIndex)
+			cfg.mu.Unlock()
+		} else if m.CommandValid {
 			if m.CommandIndex != cfg.lastApplied[i]+1 {
 				err_msg = fmt.Sprintf("server %v apply out of order, expected index %v, got %v", i, cfg.lastApplied[i]+1, m.CommandIndex)
 			}
@@ -257,6 +298,18 @@ func (cfg *config) applierSnap(i int, applyCh chan ApplyMsg) {
 			cfg.mu.Lock()
 			cfg.lastApplied[i] = m.CommandIndex
 			cfg.mu.Unlock()
+
+			if (m.CommandIndex+1)%SnapShotInterval == 0 {
+				w := new(bytes.Buffer)
+				e := labgob.NewEncoder(w)
+				e.Encode(m.CommandIndex)
+				var xlog []interface{}
+				for j := 0; j <= m.CommandIndex; j++ {
+					xlog = append(xlog, cfg.logs[i][j])
+				}
+				e.Encode(xlog)
+				rf.Snapshot(m.CommandIndex, w.Bytes())
+			}
 		} else {
 			// Ignore other types of ApplyMsg.
 		}
@@ -289,6 +342,7 @@ func (cfg *config) start1(i int, applier func(int, chan ApplyMsg)) {
 	for j := 0; j < cfg.n; j++ {
 		ends[j] = cfg.net.MakeEnd(cfg.endnames[i][j])
 		cfg.net.Connect(cfg.endnames[i][j], j)
+		cfg.net.SetHost(cfg.endnames[i][j], i)
 	}
 
 	cfg.mu.Lock()
@@ -312,20 +366,27 @@ func (cfg *config) start1(i int, applier func(int, chan ApplyMsg)) {
 			}
 		}
 	} else {
-		cfg.saved[i] = MakePersister()
+		cfg.saved[i] = cfg.makePersister()
 	}
 
 	cfg.mu.Unlock()
 
 	applyCh := make(chan ApplyMsg)
+	if cfg.sim != nil {
+		// the simulation polls it, see labsim
+		applyCh = make(chan ApplyMsg, 1)
+	}
 
-	rf := Make(ends, i, cfg.saved[i], applyCh)
+	rf, err := MakeWithOptions(ends, i, cfg.saved[i], applyCh, cfg.opts)
+	if err != nil {
+		cfg.t.Fatalf("server %v can't start: %v", i, err)
+	}
 
 	cfg.mu.Lock()
 	cfg.rafts[i] = rf
 	cfg.mu.Unlock()
 
-	go applier(i, applyCh)
+	cfg.sim.Go(func() { applier(i, applyCh) })
 
 	svc := labrpc.MakeService(rf)
 	srv := labrpc.MakeServer()
@@ -333,9 +394,40 @@ func (cfg *config) start1(i int, applier func(int, chan ApplyMsg)) {
 	cfg.net.AddServer(i, srv)
 }
 
+// runSim runs f, a test, in a simulation. its seed comes from
+// $RAFT_SIM_SEED, to replay a failure, or is a fresh one, which is
+// reported if the test fails.
+func runSim(t *testing.T, f func(s *labsim.Sim)) {
+	seed := makeSeed()
+	if v := os.Getenv("RAFT_SIM_SEED"); v != "" {
+		var err error
+		if seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			t.Fatalf("bad RAFT_SIM_SEED %q: %v", v, err)
+		}
+	}
+	defer func() {
+		if t.Failed() {
+			t.Logf("simulation seed %d; replay with RAFT_SIM_SEED=%d", seed, seed)
+		}
+	}()
+	s := labsim.New(seed)
+	s.Run(func() { f(s) })
+}
+
+// makePersister returns an empty Persister, faulty if cfg.faults is set.
+// called with cfg.mu held.
+func (cfg *config) makePersister() *Persister {
+	if cfg.faults == nil {
+		return MakePersister()
+	}
+	faults := *cfg.faults
+	faults.Seed = cfg.faultRand.Int63()
+	return MakeFaultyPersister(faults)
+}
+
 func (cfg *config) checkTimeout() {
-	// enforce a two minute real-time limit on each test
-	if !cfg.t.Failed() && time.Since(cfg.start) > 120*time.Second {
+	// enforce a two minute real-time (or simulated) limit on each test
+	if !cfg.t.Failed() && cfg.sim.Since(cfg.start) > 120*time.Second {
 		cfg.t.Fatal("test took longer than 120 seconds")
 	}
 }
@@ -353,9 +445,27 @@ func (cfg *config) cleanup() {
 		}
 	}
 	cfg.net.Cleanup()
+	if cfg.trace != nil {
+		if err := cfg.net.StopRecording(); err != nil {
+			cfg.t.Errorf("recording RPCs: %v", err)
+		}
+		cfg.trace.Close()
+	}
 	cfg.checkTimeout()
 }
 
+// record the RPCs of the test in dir/<test name>.trace, to be read with
+// labrpc.ReadRecords(), and replayed into a Raft with labrpc.Replay().
+func (cfg *config) record(dir string) {
+	name := strings.ReplaceAll(cfg.t.Name(), "/", "_") + ".trace"
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		cfg.t.Fatalf("can't record RPCs: %v", err)
+	}
+	cfg.trace = f
+	cfg.net.StartRecording(f)
+}
+
 // attach server i to the net.
 func (cfg *config) connect(i int) {
 	// fmt.Printf("connect(%d)\n", i)
@@ -406,6 +516,32 @@ func (cfg *config) disconnect(i int) {
 	cfg.logger.Log(LogDisconnectServer, "Disconnected a server")
 }
 
+// split the servers into groups that can only talk among themselves; a
+// server in several groups bridges them. unlike disconnect(), this leaves
+// cfg.connected alone, so the tester still talks to every server.
+func (cfg *config) partition(groups ...[]int) {
+	gs := make([][]interface{}, len(groups))
+	for g, group := range groups {
+		for _, i := range group {
+			gs[g] = append(gs[g], i)
+		}
+	}
+	cfg.net.Partition(gs...)
+	cfg.logger.Log(LogConnectServer, "Partitioned the servers into %v", groups)
+}
+
+// lose what server from sends to server to, but not the other way around.
+func (cfg *config) cutLink(from int, to int) {
+	cfg.net.CutLink(from, to)
+	cfg.logger.Log(LogConnectServer, "Cut the link from %v to %v", from, to)
+}
+
+// undo partition() and cutLink().
+func (cfg *config) heal() {
+	cfg.net.Heal()
+	cfg.logger.Log(LogConnectServer, "Healed the network")
+}
+
 func (cfg *config) rpcCount(server int) int {
 	return cfg.net.GetCount(server)
 }
@@ -433,8 +569,8 @@ func (cfg *config) setlongreordering(longrel bool) {
 // try a few times in case re-elections are needed.
 func (cfg *config) checkOneLeader() int {
 	for iters := 0; iters < 10; iters++ {
-		ms := 450 + (rand.Int63() % 100)
-		time.Sleep(time.Duration(ms) * time.Millisecond)
+		ms := 450 + (cfg.sim.Int63() % 100)
+		cfg.sim.Sleep(time.Duration(ms) * time.Millisecond)
 
 		leaders := make(map[int][]int)
 		for i := 0; i < cfg.n; i++ {
@@ -526,7 +662,7 @@ func (cfg *config) wait(index int, n int, startTerm int) interface{} {
 		if nd >= n {
 			break
 		}
-		time.Sleep(to)
+		cfg.sim.Sleep(to)
 		if to < time.Second {
 			to *= 2
 		}
@@ -561,9 +697,9 @@ func (cfg *config) wait(index int, n int, startTerm int) interface{} {
 // if retry==false, calls Start() only once, in order
 // to simplify the early Lab 4B tests.
 func (cfg *config) one(cmd interface{}, expectedServers int, retry bool) int {
-	t0 := time.Now()
+	t0 := cfg.sim.Now()
 	starts := 0
-	for time.Since(t0).Seconds() < 10 && cfg.checkFinished() == false {
+	for cfg.sim.Since(t0).Seconds() < 10 && cfg.checkFinished() == false {
 		// try all the servers, maybe one is the leader.
 		index := -1
 		for si := 0; si < cfg.n; si++ {
@@ -586,8 +722,8 @@ func (cfg *config) one(cmd interface{}, expectedServers int, retry bool) int {
 		if index != -1 {
 			// somebody claimed to be the leader and to have
 			// submitted our command; wait a while for agreement.
-			t1 := time.Now()
-			for time.Since(t1).Seconds() < 2 {
+			t1 := cfg.sim.Now()
+			for cfg.sim.Since(t1).Seconds() < 2 {
 				nd, cmd1 := cfg.nCommitted(index)
 				if nd > 0 && nd >= expectedServers {
 					// committed
@@ -596,13 +732,13 @@ func (cfg *config) one(cmd interface{}, expectedServers int, retry bool) int {
 						return index
 					}
 				}
-				time.Sleep(20 * time.Millisecond)
+				cfg.sim.Sleep(20 * time.Millisecond)
 			}
 			if retry == false {
 				cfg.t.Fatalf("one(%v) failed to reach agreement", cmd)
 			}
 		} else {
-			time.Sleep(50 * time.Millisecond)
+			cfg.sim.Sleep(50 * time.Millisecond)
 		}
 	}
 	if cfg.checkFinished() == false {
@@ -616,9 +752,10 @@ func (cfg *config) one(cmd interface{}, expectedServers int, retry bool) int {
 // e.g. cfg.begin("Test (4B): RPC counts aren't too high")
 func (cfg *config) begin(description string) {
 	fmt.Printf("%s ...\n", description)
-	cfg.t0 = time.Now()
+	cfg.t0 = cfg.sim.Now()
 	cfg.rpcs0 = cfg.rpcTotal()
 	cfg.bytes0 = cfg.bytesTotal()
+	cfg.net.ResetStats()
 	cfg.cmds0 = 0
 	cfg.maxIndex0 = cfg.maxIndex
 }
@@ -626,12 +763,12 @@ func (cfg *config) begin(description string) {
 // end a Test -- the fact that we got here means there
 // was no failure.
 // print the Passed message,
-// and some performance numbers.
+// and some performance numbers, overall and by RPC method.
 func (cfg *config) end() {
 	cfg.checkTimeout()
 	if cfg.t.Failed() == false {
 		cfg.mu.Lock()
-		t := time.Since(cfg.t0).Seconds()       // real time
+		t := cfg.sim.Since(cfg.t0).Seconds()    // real (or simulated) time
 		npeers := cfg.n                         // number of Raft peers
 		nrpc := cfg.rpcTotal() - cfg.rpcs0      // number of RPC sends
 		nbytes := cfg.bytesTotal() - cfg.bytes0 // number of bytes
@@ -640,6 +777,16 @@ func (cfg *config) end() {
 
 		fmt.Printf("  ... Passed --")
 		fmt.Printf("  %4.1f  %d %4d %7d %4d\n", t, npeers, nrpc, nbytes, ncmds)
+
+		st := cfg.net.Stats()
+		methods := []string{}
+		for m := range st.Methods {
+			methods = append(methods, m)
+		}
+		sort.Strings(methods)
+		for _, m := range methods {
+			fmt.Printf("      %-20s %v\n", m, st.Methods[m])
+		}
 	}
 }
 
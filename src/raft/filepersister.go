@@ -0,0 +1,377 @@
+package raft
+
+//
+// a Storage that keeps its contents on disk, so they survive a restart of
+// the process.
+//
+// ps, err := OpenFilePersister(dir)
+//   open (or create) the FilePersister kept in dir, recovering whatever
+//   was saved there before.
+// ps.Close()
+//   close it; the contents stay in dir.
+//
+// dir holds two files. "state" has the Raft state and the snapshot as of
+// the last Save() or SaveState(), and a generation number; those rewrite it
+// as a whole, atomically, by writing a temporary file and renaming it over
+// the old one. AppendState() appends to "wal-<generation>", a write-ahead
+// log of what has been appended to the Raft state since. every write is
+// fsynced before the method returns.
+//
+// each piece of the WAL carries its length and a checksum, so that a write
+// torn by a crash is recognised, and dropped, when the FilePersister is
+// opened again. the last piece is torn if it is cut short by the end of
+// the WAL, or fails its checksum; one that does either with whole pieces
+// after it makes OpenFilePersister() fail with a *CorruptStateError, since
+// dropping it would drop the fsynced pieces after it too. so does a
+// "state" that fails its checksum, which a rename can't tear. a WAL of an
+// older generation is left over if a crash happens right after "state" is
+// replaced; it is removed, too.
+//
+// the methods have no way to report an error, and Raft can't go on if it
+// can't persist its state, so they panic if writing fails.
+//
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	stateFile  = "state"
+	walPrefix  = "wal-"
+	tempSuffix = ".tmp"
+)
+
+// FilePersister keeps a copy of its contents in memory, to read from, and
+// writes them through to dir.
+type FilePersister struct {
+	mu        sync.Mutex
+	raftstate []byte
+	snapshot  []byte
+	dir       string
+	gen       uint64   // generation of the "state" file
+	wal       *os.File // WAL of that generation
+}
+
+// OpenFilePersister returns a FilePersister that keeps its contents in
+// dir, starting with whatever was saved there.
+func OpenFilePersister(dir string) (*FilePersister, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	ps := &FilePersister{dir: dir}
+	if err := ps.readState(); err != nil {
+		return nil, err
+	}
+	if err := ps.readWAL(); err != nil {
+		return nil, err
+	}
+	if err := ps.removeStale(); err != nil {
+		ps.wal.Close()
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Close closes the files of the FilePersister.
+func (ps *FilePersister) Close() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.wal == nil {
+		return nil
+	}
+	err := ps.wal.Close()
+	ps.wal = nil
+	return err
+}
+
+// readState reads "state", if there is one.
+// its layout is the generation (8 bytes), the Raft state and the snapshot,
+// each preceded by its length, and the checksum of all that (4 bytes).
+func (ps *FilePersister) readState() error {
+	data, err := os.ReadFile(filepath.Join(ps.dir, stateFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	corrupt := func(body []byte, reason string) error {
+		return &CorruptStateError{len(data) - 4 - len(body), stateFile + ": " + reason}
+	}
+	if len(data) < 12 {
+		return &CorruptStateError{0, stateFile + ": too short"}
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return &CorruptStateError{len(data) - 4, stateFile + ": checksum mismatch"}
+	}
+	ps.gen = binary.LittleEndian.Uint64(body)
+	body = body[8:]
+	rest := body
+	if ps.raftstate, rest = readPiece(body); ps.raftstate == nil {
+		return corrupt(body, "bad Raft state")
+	}
+	body = rest
+	if ps.snapshot, rest = readPiece(body); ps.snapshot == nil {
+		return corrupt(body, "bad snapshot")
+	}
+	if len(rest) != 0 {
+		return corrupt(rest, "trailing bytes")
+	}
+	return nil
+}
+
+// readWAL appends the pieces in the WAL of the current generation to the
+// Raft state, drops a torn one at its end, and opens it for appending.
+func (ps *FilePersister) readWAL() error {
+	f, err := os.OpenFile(ps.walPath(), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	corrupt := func(off int, reason string) error {
+		f.Close()
+		return &CorruptStateError{off, filepath.Base(ps.walPath()) + ": " + reason}
+	}
+	good := 0
+	for good < len(data) {
+		piece, size, err := readWALPiece(data[good:])
+		if err != nil && size > 0 && !walPieceAfter(data, good+1) {
+			// a last piece that fails its checksum: torn too
+			break
+		}
+		if err != nil {
+			return corrupt(good, err.Error())
+		}
+		if size == 0 {
+			if walPieceAfter(data, good+1) {
+				return corrupt(good, "bad length")
+			}
+			break
+		}
+		ps.raftstate = append(ps.raftstate, piece...)
+		good += size
+	}
+	if good < len(data) {
+		// torn by a crash in the middle of AppendState(), which hadn't returned
+		if err := f.Truncate(int64(good)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if _, err := f.Seek(int64(good), io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	ps.wal = f
+	return nil
+}
+
+// removeStale removes what crashes may have left behind: temporary files
+// and WALs of other generations.
+func (ps *FilePersister) removeStale() error {
+	entries, err := os.ReadDir(ps.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, tempSuffix) ||
+			(strings.HasPrefix(name, walPrefix) && filepath.Join(ps.dir, name) != ps.walPath()) {
+			if err := os.Remove(filepath.Join(ps.dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ps *FilePersister) walPath() string {
+	return filepath.Join(ps.dir, fmt.Sprintf("%s%d", walPrefix, ps.gen))
+}
+
+// writeState replaces "state" with the current contents, in the next
+// generation, and starts a new WAL. called with ps.mu held.
+func (ps *FilePersister) writeState() {
+	gen := ps.gen + 1
+	body := binary.LittleEndian.AppendUint64(nil, gen)
+	body = appendPiece(body, ps.raftstate)
+	body = appendPiece(body, ps.snapshot)
+	body = binary.LittleEndian.AppendUint32(body, crc32.ChecksumIEEE(body))
+
+	path := filepath.Join(ps.dir, stateFile)
+	must(writeFileSync(path+tempSuffix, body))
+	must(os.Rename(path+tempSuffix, path))
+	must(syncDir(ps.dir))
+
+	// the old WAL is part of the old generation; everything in it is in "state" now
+	old := ps.walPath()
+	ps.gen = gen
+	wal, err := os.OpenFile(ps.walPath(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	must(err)
+	// "state" names the new WAL, so it has to be there after a crash
+	must(syncDir(ps.dir))
+	if ps.wal != nil {
+		ps.wal.Close()
+	}
+	ps.wal = wal
+	must(os.Remove(old))
+}
+
+// appendWAL appends data to the WAL. called with ps.mu held.
+func (ps *FilePersister) appendWAL(data []byte) {
+	buf := appendPiece(nil, data)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(data))
+	_, err := ps.wal.Write(buf)
+	must(err)
+	must(ps.wal.Sync())
+}
+
+// Copy returns an in-memory copy of the contents.
+func (ps *FilePersister) Copy() Storage {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	np := MakePersister()
+	np.Save(ps.raftstate, ps.snapshot)
+	return np
+}
+
+func (ps *FilePersister) ReadRaftState() []byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return clone(ps.raftstate)
+}
+
+func (ps *FilePersister) RaftStateSize() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.raftstate)
+}
+
+// Save replaces the Raft state and the snapshot, atomically.
+func (ps *FilePersister) Save(raftstate []byte, snapshot []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.raftstate = clone(raftstate)
+	ps.snapshot = clone(snapshot)
+	ps.writeState()
+}
+
+func (ps *FilePersister) SaveState(raftstate []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.raftstate = clone(raftstate)
+	ps.writeState()
+}
+
+// AppendState adds data to the end of the Raft state, through the WAL.
+func (ps *FilePersister) AppendState(data []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.raftstate = append(ps.raftstate, data...)
+	ps.appendWAL(data)
+}
+
+func (ps *FilePersister) ReadSnapshot() []byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return clone(ps.snapshot)
+}
+
+func (ps *FilePersister) SnapshotSize() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.snapshot)
+}
+
+// appendPiece appends data, preceded by its length, to buf.
+func appendPiece(buf []byte, data []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// readPiece reads what appendPiece() wrote from the start of buf, and
+// returns it (nil if buf doesn't start with a whole piece) and the rest.
+func readPiece(buf []byte) ([]byte, []byte) {
+	n, k := binary.Uvarint(buf)
+	if k <= 0 || n > uint64(len(buf)-k) {
+		return nil, buf
+	}
+	return bytes.Clone(buf[k : k+int(n)]), buf[k+int(n):]
+}
+
+// readWALPiece reads the piece appendWAL() wrote at the start of buf, and
+// returns it and its size in buf; a size of 0 if buf ends before it does.
+// a piece that fails its checksum comes with its size, and an error.
+func readWALPiece(buf []byte) ([]byte, int, error) {
+	n, k := binary.Uvarint(buf)
+	if k < 0 {
+		return nil, 0, errors.New("bad length")
+	}
+	if k == 0 || len(buf)-k < 4 || n > uint64(len(buf)-k-4) {
+		return nil, 0, nil
+	}
+	piece := buf[k : k+int(n)]
+	if crc32.ChecksumIEEE(piece) != binary.LittleEndian.Uint32(buf[k+int(n):]) {
+		return nil, k + int(n) + 4, errors.New("checksum mismatch")
+	}
+	return piece, k + int(n) + 4, nil
+}
+
+// walPieceAfter says whether a whole piece, that isn't empty, starts
+// anywhere in data from offset from on.
+func walPieceAfter(data []byte, from int) bool {
+	for off := from; off < len(data); off++ {
+		if piece, size, err := readWALPiece(data[off:]); err == nil && size > 0 && len(piece) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func must(err error) {
+	if err != nil {
+		panic(fmt.Sprintf("raft: can't persist state: %v", err))
+	}
+}
@@ -0,0 +1,299 @@
+package raft
+
+//
+// the layout of the persisted Raft state.
+//
+// the state is a header, stateMagic and the format version, followed by
+// a sequence of records: a kind byte, the length of the body, the body,
+// and a CRC-32 of all that. persist() only appends records for what changed
+// since the last write: the hard state (term and vote) if it changed, and
+// the log entries past the last persisted one. a log record starts at an
+// index and replaces whatever the log had from there on, which is how a
+// truncated log is persisted. readPersist() replays the records in order.
+//
+// superseded records are garbage; persistAll() rewrites the state as one
+// base record, one hard state record and one log record whenever the
+// records grow to twice the size of the last rewrite, whenever the
+// snapshot changes, and when the peer starts.
+//
+// records are small since a lot of them get written: everything but the
+// entries (which are labgob-encoded) is varints.
+//
+// readPersist() won't start from a state it can't trust; a peer that has
+// forgotten its term or vote could vote twice. a state without the header,
+// of another version, or with a record that fails its checksum is corrupt.
+// the one exception is a record cut short at the very end: that is an
+// append torn by a crash, which never returned, so it is dropped. a record
+// that runs past the end, but with whole records after where it starts,
+// is the last of nothing: its length is bad, and the state is corrupt.
+//
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+
+	"lab4/labgob"
+)
+
+var stateMagic = []byte("RAFT")
+
+const stateVersion = 1
+
+var ErrCorruptState = errors.New("raft: persisted state is corrupt")
+
+// CorruptStateError says where and why the persisted state is corrupt.
+// errors.Is(err, ErrCorruptState) holds for it.
+type CorruptStateError struct {
+	Offset int // of the header or record at fault
+	Reason string
+}
+
+func (e *CorruptStateError) Error() string {
+	return fmt.Sprintf("raft: persisted state is corrupt at byte %d: %s", e.Offset, e.Reason)
+}
+
+func (e *CorruptStateError) Unwrap() error {
+	return ErrCorruptState
+}
+
+type recordKind byte
+
+const (
+	recordBase      recordKind = iota // what the snapshot covers; the log restarts after it
+	recordHardState                   // currTerm and votedFor
+	recordLog                         // entries from an index on
+)
+
+// stateRecord is a decoded record; which fields are set depends on Kind.
+type stateRecord struct {
+	Kind recordKind
+
+	// recordBase
+	LastIncludedIndex int
+	LastIncludedTerm  int32
+	Members           []bool // configuration as of LastIncludedIndex
+	Learners          []bool
+
+	// recordHardState
+	Term     int32
+	VotedFor int
+
+	// recordLog
+	Index   int
+	Entries []LogEntry
+}
+
+// appendHeader appends the header of the state to buf.
+func appendHeader(buf []byte) []byte {
+	buf = append(buf, stateMagic...)
+	return append(buf, stateVersion)
+}
+
+// appendRecord appends rec, framed with its kind, length and checksum, to buf.
+func appendRecord(buf []byte, rec stateRecord) []byte {
+	var body []byte
+	switch rec.Kind {
+	case recordBase:
+		body = binary.AppendVarint(body, int64(rec.LastIncludedIndex))
+		body = binary.AppendVarint(body, int64(rec.LastIncludedTerm))
+		body = appendBools(body, rec.Members)
+		body = appendBools(body, rec.Learners)
+	case recordHardState:
+		body = binary.AppendVarint(body, int64(rec.Term))
+		body = binary.AppendVarint(body, int64(rec.VotedFor))
+	case recordLog:
+		body = binary.AppendVarint(body, int64(rec.Index))
+		w := bytes.NewBuffer(body)
+		e := labgob.NewEncoder(w)
+		e.Encode(rec.Entries)
+		body = w.Bytes()
+	}
+
+	start := len(buf)
+	buf = append(buf, byte(rec.Kind))
+	buf = binary.AppendUvarint(buf, uint64(len(body)))
+	buf = append(buf, body...)
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[start:]))
+}
+
+func appendBools(buf []byte, bs []bool) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(bs)))
+	for _, b := range bs {
+		if b {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+	}
+	return buf
+}
+
+// decodeRecords checks the header of data and splits the rest into the
+// records appendRecord() wrote.
+func decodeRecords(data []byte) ([]stateRecord, error) {
+	if len(data) < len(stateMagic)+1 || !bytes.Equal(data[:len(stateMagic)], stateMagic) {
+		return nil, &CorruptStateError{0, "no header"}
+	}
+	if v := data[len(stateMagic)]; v != stateVersion {
+		return nil, &CorruptStateError{0, fmt.Sprintf("format version %d, expected %d", v, stateVersion)}
+	}
+
+	records := []stateRecord{}
+	off := len(stateMagic) + 1
+	for off < len(data) {
+		n, k := binary.Uvarint(data[off+1:])
+		if k < 0 {
+			return nil, &CorruptStateError{off, "bad length"}
+		}
+		if k == 0 {
+			// the length itself is cut short by the end: torn
+			break
+		}
+		if n > uint64(len(data)-(off+1+k+4)) || off+1+k+4 > len(data) {
+			if recordAfter(data, off+1) {
+				return nil, &CorruptStateError{off, "bad length"}
+			}
+			// torn
+			break
+		}
+		end := off + 1 + k + int(n)
+		if crc32.ChecksumIEEE(data[off:end]) != binary.LittleEndian.Uint32(data[end:]) {
+			return nil, &CorruptStateError{off, "checksum mismatch"}
+		}
+
+		r := &recordReader{buf: data[off+1+k : end], ok: true}
+		rec := stateRecord{Kind: recordKind(data[off])}
+		switch rec.Kind {
+		case recordBase:
+			rec.LastIncludedIndex = int(r.varint())
+			rec.LastIncludedTerm = int32(r.varint())
+			rec.Members = r.bools()
+			rec.Learners = r.bools()
+		case recordHardState:
+			rec.Term = int32(r.varint())
+			rec.VotedFor = int(r.varint())
+		case recordLog:
+			rec.Index = int(r.varint())
+			if r.ok {
+				d := labgob.NewDecoder(bytes.NewBuffer(r.buf))
+				r.ok = d.Decode(&rec.Entries) == nil
+			}
+		default:
+			return nil, &CorruptStateError{off, fmt.Sprintf("unknown record kind %d", rec.Kind)}
+		}
+		if !r.ok {
+			return nil, &CorruptStateError{off, "malformed record"}
+		}
+		records = append(records, rec)
+		off = end + 4
+	}
+	return records, nil
+}
+
+// recordAfter says whether a whole record, checksum and all, starts
+// anywhere in data from offset from on.
+func recordAfter(data []byte, from int) bool {
+	for off := from; off < len(data); off++ {
+		if recordKind(data[off]) > recordLog {
+			continue
+		}
+		n, k := binary.Uvarint(data[off+1:])
+		if k <= 0 || off+1+k+4 > len(data) || n > uint64(len(data)-(off+1+k+4)) {
+			continue
+		}
+		end := off + 1 + k + int(n)
+		if crc32.ChecksumIEEE(data[off:end]) == binary.LittleEndian.Uint32(data[end:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordReader reads the fields of a record body; ok turns false at the first one it can't.
+type recordReader struct {
+	buf []byte
+	ok  bool
+}
+
+func (r *recordReader) varint() int64 {
+	if !r.ok {
+		return 0
+	}
+	x, k := binary.Varint(r.buf)
+	if k <= 0 {
+		r.ok = false
+		return 0
+	}
+	r.buf = r.buf[k:]
+	return x
+}
+
+func (r *recordReader) bools() []bool {
+	if !r.ok {
+		return nil
+	}
+	n, k := binary.Uvarint(r.buf)
+	if k <= 0 || n > uint64(len(r.buf)-k) {
+		r.ok = false
+		return nil
+	}
+	bs := make([]bool, n)
+	for i := range bs {
+		bs[i] = r.buf[k+i] != 0
+	}
+	r.buf = r.buf[k+int(n):]
+	return bs
+}
+
+// persistAll rewrites the whole state, and the snapshot with it.
+func (rf *Raft) persistAll() {
+	buf := appendRecord(appendHeader(nil), stateRecord{
+		Kind:              recordBase,
+		LastIncludedIndex: rf.lastIncludedIndex,
+		LastIncludedTerm:  rf.lastIncludedTerm,
+		Members:           rf.baseMembers,
+		Learners:          rf.baseLearners,
+	})
+	buf = appendRecord(buf, stateRecord{Kind: recordHardState, Term: rf.currTerm, VotedFor: rf.votedFor})
+	buf = appendRecord(buf, stateRecord{Kind: recordLog, Index: rf.lastIncludedIndex + 1, Entries: rf.logs[1:]})
+	rf.persister.Save(buf, rf.snapshot)
+	rf.checkStorage()
+
+	rf.stateSize = len(buf)
+	rf.persistedTerm = rf.currTerm
+	rf.persistedVote = rf.votedFor
+	rf.persistedIndex = rf.lastLogIndex()
+}
+
+// failingStorage is a Storage that can stop taking writes, as a faulty
+// Persister does once it has crashed.
+type failingStorage interface {
+	Failed() bool
+}
+
+// checkStorage stops rf, as if killed, if its Storage has stopped taking
+// writes: a peer mustn't act on a write that didn't stick, e.g. count
+// itself towards committing an entry. called with rf.mu held, after each
+// write.
+func (rf *Raft) checkStorage() {
+	if fs, ok := rf.persister.(failingStorage); ok && fs.Failed() {
+		rf.Kill()
+	}
+}
+
+// truncateLog drops the entries from absolute index i on, and undoes the
+// ConfigChanges among them.
+func (rf *Raft) truncateLog(i int) {
+	rf.logs = rf.logs[:i-rf.lastIncludedIndex]
+	if rf.persistedIndex >= i {
+		rf.persistedIndex = i - 1
+	}
+	if rf.configIndex >= i {
+		rf.configs = rf.configs[:sort.SearchInts(rf.configs, i)]
+		rf.updateConfig()
+	}
+}
@@ -8,31 +8,172 @@ package raft
 // so, while you can modify this code to help you debug, please
 // test with the original before submitting.
 //
+// MakeFaultyPersister(faults) returns a Persister that injects the faults
+// a crash can cause, for tests: writes take a while to become durable,
+// and a crash (Copy()) in the middle of one loses it or tears it.
+//
 
-import "sync"
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
 
+// Storage is where Raft keeps its persistent state and the service's
+// snapshot. Persister keeps them in memory, FilePersister on disk; Make()
+// takes either, or any other implementation.
+//
+// Save() must replace both atomically, and no method may return before
+// what it wrote is durable.
+type Storage interface {
+	Save(raftstate []byte, snapshot []byte)
+	SaveState(raftstate []byte)
+	AppendState(data []byte)
+	ReadRaftState() []byte
+	ReadSnapshot() []byte
+	RaftStateSize() int
+	SnapshotSize() int
+	// Copy returns an in-memory copy of the contents.
+	Copy() Storage
+}
+
+// Persister is the in-memory Storage the tester uses.
 type Persister struct {
 	mu        sync.Mutex
 	raftstate []byte
 	snapshot  []byte
+	faults    *faultInjector // nil unless made by MakeFaultyPersister()
 }
 
 func MakePersister() *Persister {
 	return &Persister{}
 }
 
+// Faults is the policy of a faulty Persister. the random choices it makes
+// come from Seed, so a policy with the same seed makes the same ones.
+type Faults struct {
+	Seed int64
+
+	// a write takes between MinDelay and MaxDelay to become durable, and
+	// doesn't return before it has.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	// the chances that a crash in the middle of a write keeps only part
+	// of it (AppendState() only; a torn Save() or SaveState() is lost as
+	// a whole, since they are atomic), or loses it. otherwise the write
+	// made it to disk just before the crash.
+	TearRate float64
+	LoseRate float64
+}
+
+// faultInjector is the state of a faulty Persister, guarded by its mu.
+type faultInjector struct {
+	Faults
+	rng     *rand.Rand
+	wmu     sync.Mutex    // one write at a time
+	pending *pendingWrite // the write in progress, if any
+	crashed bool
+}
+
+// pendingWrite is a write that isn't durable yet.
+type pendingWrite struct {
+	apply    func(ps *Persister) // does the write
+	appended []byte              // what AppendState() appends; nil for the others
+}
+
+// MakeFaultyPersister returns an empty Persister that injects faults.
+//
+// Copy() is a crash: the copy holds what was durable, plus whatever
+// faults decides is left of a write in progress, and injects faults of
+// its own. the Persister that was copied drops its writes from then on,
+// the one in progress included, and Failed() says so: the server using
+// it is gone, and mustn't act on what it writes. the writes return, since
+// Raft makes them holding its lock.
+func MakeFaultyPersister(faults Faults) *Persister {
+	return &Persister{faults: &faultInjector{
+		Faults: faults,
+		rng:    rand.New(rand.NewSource(faults.Seed)),
+	}}
+}
+
+// write does w, injecting faults if this is a faulty Persister.
+func (ps *Persister) write(w *pendingWrite) {
+	f := ps.faults
+	if f == nil {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		w.apply(ps)
+		return
+	}
+
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+
+	ps.mu.Lock()
+	if f.crashed {
+		ps.mu.Unlock()
+		return
+	}
+	f.pending = w
+	delay := f.MinDelay
+	if f.MaxDelay > f.MinDelay {
+		delay += time.Duration(f.rng.Int63n(int64(f.MaxDelay - f.MinDelay)))
+	}
+	ps.mu.Unlock()
+
+	time.Sleep(delay)
+
+	ps.mu.Lock()
+	if f.crashed {
+		ps.mu.Unlock()
+		return
+	}
+	w.apply(ps)
+	f.pending = nil
+	ps.mu.Unlock()
+}
+
+// Failed says whether ps has crashed, and drops its writes; only a faulty
+// Persister does.
+func (ps *Persister) Failed() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.faults != nil && ps.faults.crashed
+}
+
 func clone(orig []byte) []byte {
 	x := make([]byte, len(orig))
 	copy(x, orig)
 	return x
 }
 
-func (ps *Persister) Copy() *Persister {
+func (ps *Persister) Copy() Storage {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	np := MakePersister()
-	np.raftstate = ps.raftstate
+	// AppendState() may grow raftstate in place, so don't share it
+	np.raftstate = clone(ps.raftstate)
 	np.snapshot = ps.snapshot
+
+	if f := ps.faults; f != nil {
+		if w := f.pending; w != nil {
+			r := f.rng.Float64()
+			switch {
+			case w.appended != nil && r < f.TearRate:
+				np.raftstate = append(np.raftstate, w.appended[:f.rng.Intn(len(w.appended))]...)
+			case r < f.TearRate+f.LoseRate:
+				// lost
+			default:
+				w.apply(np)
+			}
+		}
+		f.crashed = true
+
+		faults := f.Faults
+		faults.Seed = f.rng.Int63()
+		np.faults = MakeFaultyPersister(faults).faults
+	}
 	return np
 }
 
@@ -51,16 +192,31 @@ func (ps *Persister) RaftStateSize() int {
 // Save both Raft state and K/V snapshot as a single atomic action,
 // to help avoid them getting out of sync.
 func (ps *Persister) Save(raftstate []byte, snapshot []byte) {
-	ps.mu.Lock()
-	defer ps.mu.Unlock()
-	ps.raftstate = clone(raftstate)
-	ps.snapshot = clone(snapshot)
+	raftstate = clone(raftstate)
+	snapshot = clone(snapshot)
+	ps.write(&pendingWrite{apply: func(ps *Persister) {
+		ps.raftstate = raftstate
+		ps.snapshot = snapshot
+	}})
 }
 
 func (ps *Persister) SaveState(raftstate []byte) {
-	ps.mu.Lock()
-	defer ps.mu.Unlock()
-	ps.raftstate = clone(raftstate)
+	raftstate = clone(raftstate)
+	ps.write(&pendingWrite{apply: func(ps *Persister) {
+		ps.raftstate = raftstate
+	}})
+}
+
+// AppendState adds data to the end of the Raft state, leaving the rest
+// of it and the snapshot alone.
+func (ps *Persister) AppendState(data []byte) {
+	data = clone(data)
+	ps.write(&pendingWrite{
+		apply: func(ps *Persister) {
+			ps.raftstate = append(ps.raftstate, data...)
+		},
+		appended: data,
+	})
 }
 
 func (ps *Persister) ReadSnapshot() []byte {
@@ -20,9 +20,9 @@ package raft
 import (
 	//	"bytes"
 
-	"bytes"
+	"context"
 	"fmt"
-	"math/rand"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -30,6 +30,7 @@ import (
 	"lab4/constants"
 	"lab4/labgob"
 	"lab4/labrpc"
+	"lab4/labsim"
 	"lab4/logger"
 )
 
@@ -38,10 +39,20 @@ import (
 // tester) on the same server, via the applyCh passed to Make(). set
 // CommandValid to true to indicate that the ApplyMsg contains a newly
 // committed log entry.
+//
+// in part 4D you'll want to send other kinds of messages (e.g.,
+// snapshots) on the applyCh; for those, set CommandValid to false
+// and SnapshotValid to true.
 type ApplyMsg struct {
 	CommandValid bool
 	Command      interface{}
 	CommandIndex int
+
+	// For 4D:
+	SnapshotValid bool
+	Snapshot      []byte
+	SnapshotTerm  int
+	SnapshotIndex int
 }
 
 type RaftState int
@@ -50,6 +61,7 @@ const (
 	Follower = iota
 	Candidate
 	Leader
+	Learner // gets the log and applies it, but neither votes nor counts towards commitment
 )
 
 // Log Structure
@@ -58,15 +70,90 @@ type LogEntry struct {
 	Command interface{}
 }
 
+type ConfigOp int
+
+const (
+	ConfigAddServer ConfigOp = iota
+	ConfigRemoveServer
+	ConfigAddLearner
+)
+
+// ConfigChange is the command of a log entry that adds or removes one
+// server (an index into peers[]) from the configuration, or makes it a
+// learner: a non-voting member that receives the log. it takes effect
+// as soon as it is appended to a log, committed or not, and is delivered
+// on applyCh like any other command once committed.
+type ConfigChange struct {
+	Op     ConfigOp
+	Server int
+}
+
+func init() {
+	labgob.Register(ConfigChange{})
+}
+
+// Options tunes a Raft peer beyond what Make() sets up by default.
+type Options struct {
+	// Members are the peers (indexes into peers[]) that make up the
+	// configuration when there is no persisted state. nil means every peer.
+	Members []int
+
+	// PreVote makes a peer whose election timer fires first ask the others
+	// whether it could win, and only bump its term and run a real election
+	// if a majority says yes. this keeps a peer that was partitioned away
+	// from forcing the leader to step down when it rejoins.
+	PreVote bool
+
+	// LeaseRead lets the leader serve reads without a round of HBs for a
+	// while after a majority acknowledged one (see LeaseRead()). it relies on
+	// clocks: ClockDrift bounds how far the peers' clocks may drift apart
+	// over an election timeout, and the lease is shortened by that much.
+	LeaseRead  bool
+	ClockDrift time.Duration
+
+	// MaxEntriesPerAppend caps the entries in one AppendEntries RPC, and
+	// MaxInflightAppends the AppendEntries RPCs a leader has outstanding
+	// to one follower. zero means the defaults below.
+	MaxEntriesPerAppend int
+	MaxInflightAppends  int
+
+	// SnapshotChunkSize caps the bytes of snapshot in one InstallSnapshot
+	// RPC; a larger snapshot is sent in chunks, MaxInflightAppends of them
+	// at a time. zero means the default below.
+	SnapshotChunkSize int
+
+	// Sim runs the peer in a deterministic simulation (see labsim), on its
+	// virtual clock and with its random numbers, instead of real time and
+	// math/rand. the network and the service have to be in it too.
+	Sim *labsim.Sim
+}
+
+const (
+	defaultMaxEntriesPerAppend = 64
+	defaultMaxInflightAppends  = 4
+	defaultSnapshotChunkSize   = 64 << 10
+)
+
+// elections time out after electionTimeoutMin plus up to electionTimeoutSpan
+// milliseconds without hearing from a leader.
+const (
+	electionTimeoutMin  = 350
+	electionTimeoutSpan = 150
+)
+
+// the leader sends a round of HBs this often.
+const hbInterval = 100 * time.Millisecond
+
 // A Go object implementing a single Raft peer.
 type Raft struct {
 	mu        sync.Mutex          // Lock to protect shared access to this peer's state
 	peers     []*labrpc.ClientEnd // RPC end points of all peers
-	persister *Persister          // Object to hold this peer's persisted state
+	persister Storage             // Object to hold this peer's persisted state
 	me        int                 // this peer's index into peers[]
 	dead      int32               // set by Kill()
 	leaderId  int                 // the id of the leader for the current term
 	logger    *logger.Logger
+	sim       *labsim.Sim // nil unless simulated; starts goroutines, and keeps time
 
 	// Your data here (4A, 4B, 4C).
 	// Look at the paper's Figure 2 for a description of what
@@ -75,6 +162,10 @@ type Raft struct {
 	currTerm  int32     // current term at this Raft
 	votedFor  int       // the peer this Raft voted for during the last election
 	heartbeat bool      // keeps track of the heartbeats
+	preVote   bool      // run a PreVote round before each election
+	// lastContact is when I last heard from the leader of my term; I refuse
+	// pre-votes for a while after it, since that leader is probably alive
+	lastContact time.Time
 
 	// 4B
 	logs        []LogEntry
@@ -83,6 +174,70 @@ type Raft struct {
 	nextIndex   []int
 	matchIndex  []int
 	applyCh     chan ApplyMsg
+	applyCond   *labsim.Cond // signalled whenever there is something new for the applier to send
+
+	// group commit
+	// Start() doesn't persist the entries it appends; the flusher persists
+	// everything appended since its last write at once
+	persistedIndex int          // the last log index that has been persisted
+	flushCond      *labsim.Cond // signalled when Start() appends entries
+
+	// what the persisted records say, so persist() only writes what changed
+	persistedTerm int32
+	persistedVote int
+	stateSize     int // size of the state as of the last persistAll()
+
+	// 4D
+	// logs[0] is a placeholder for the last entry covered by the snapshot,
+	// so the entry at absolute index i lives at logs[i-lastIncludedIndex]
+	lastIncludedIndex int
+	lastIncludedTerm  int32
+	snapshot          []byte
+	snapshotPending   bool // a snapshot from the leader still has to be sent on applyCh
+	incoming          *partialSnapshot
+
+	// membership
+	// baseMembers is the configuration as of lastIncludedIndex; members is that
+	// with every ConfigChange in the log applied, which is the one in effect.
+	// members only has the voters; learners are kept apart
+	baseMembers  []bool
+	baseLearners []bool
+	members      []bool
+	learners     []bool
+	configIndex  int   // index of the latest ConfigChange in the log, 0 if none
+	configs      []int // indexes of the ConfigChanges in the log, in order
+
+	// reads
+	// every round of HBs the leader sends gets a number; hbAcked[i] is the
+	// latest round peer i answered in my term, which proves I was still the
+	// leader when that round went out
+	hbRound  uint64
+	hbAcked  []uint64
+	readCond *labsim.Cond // broadcast when HBs are acked or entries applied
+
+	// leases
+	leaseRead  bool
+	clockDrift time.Duration
+	hbAckedAt  []time.Time // when the round in hbAcked[i] was sent
+
+	// leadership transfer
+	transferTarget int // the peer I'm handing leadership to, -1 if none
+
+	// replication pipeline, see replication.go
+	maxEntries    int
+	maxInflight   int
+	snapshotChunk int
+	out           []*peerRPCs       // the RPCs out to each peer, while I lead
+	inflight      []map[uint64]bool // tokens of the AppendEntries (or InstallSnapshot) RPCs outstanding per peer
+	lastToken     uint64            // of the latest RPC the replicators sent
+	lastSentAt    []time.Time       // when the replicator last sent peer i something
+	sentCommit    []int             // the commit index last sent to peer i
+	snapshotNext  []snapshotOffset  // how much of my snapshot peer i has, as it last said
+	replCond      *labsim.Cond      // broadcast when a replicator might have something to send
+
+	// the RPCs I send as a leader are abandoned when I stop leading
+	leading     context.Context
+	stopLeading context.CancelFunc
 }
 
 // return currentTerm and whether this server
@@ -104,37 +259,233 @@ func (rf *Raft) GetState() (int, bool) {
 // (or nil if there's not yet a snapshot).
 func (rf *Raft) persist() {
 	// Your code here (4C).
-	w := new(bytes.Buffer)
-	e := labgob.NewEncoder(w)
-	e.Encode(rf.currTerm)
-	e.Encode(rf.votedFor)
-	e.Encode(rf.logs)
-	raftstate := w.Bytes()
-	rf.persister.Save(raftstate, nil)
+	// only write what changed since the last time, see persist.go
+	var buf []byte
+	if rf.currTerm != rf.persistedTerm || rf.votedFor != rf.persistedVote {
+		buf = appendRecord(buf, stateRecord{Kind: recordHardState, Term: rf.currTerm, VotedFor: rf.votedFor})
+	}
+	if rf.persistedIndex < rf.lastLogIndex() {
+		buf = appendRecord(buf, stateRecord{
+			Kind:    recordLog,
+			Index:   rf.persistedIndex + 1,
+			Entries: rf.logs[rf.persistedIndex+1-rf.lastIncludedIndex:],
+		})
+	}
+	if len(buf) == 0 {
+		return
+	}
+
+	if rf.persister.RaftStateSize()+len(buf) > 2*rf.stateSize {
+		// too much of it is garbage
+		rf.persistAll()
+		return
+	}
+	rf.persister.AppendState(buf)
+	rf.checkStorage()
+	rf.persistedTerm = rf.currTerm
+	rf.persistedVote = rf.votedFor
+	rf.persistedIndex = rf.lastLogIndex()
 }
 
 // restore previously persisted state.
-func (rf *Raft) readPersist(data []byte) {
+// it returns a *CorruptStateError, and leaves rf alone, if data is corrupt.
+func (rf *Raft) readPersist(data []byte) error {
 	if data == nil || len(data) < 1 { // bootstrap without any state?
-		return
+		return nil
 	}
 	// Your code here (4C).
-	// Example:
-	r := bytes.NewBuffer(data)
-	d := labgob.NewDecoder(r)
+	records, err := decodeRecords(data)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 || records[0].Kind != recordBase {
+		return &CorruptStateError{0, "no base record"}
+	}
+
+	// replay the records in the order they were written
 	var currTerm int32
 	var votedFor int
 	var logs []LogEntry
-	if d.Decode(&currTerm) != nil ||
-		d.Decode(&votedFor) != nil ||
-		d.Decode(&logs) != nil {
-		//error...
-		rf.logger.Log(0, "Error reading persisted state")
+	var lastIncludedIndex int
+	var lastIncludedTerm int32
+	var baseMembers []bool
+	var baseLearners []bool
+	for _, rec := range records {
+		switch rec.Kind {
+		case recordBase:
+			lastIncludedIndex = rec.LastIncludedIndex
+			lastIncludedTerm = rec.LastIncludedTerm
+			baseMembers = rec.Members
+			baseLearners = rec.Learners
+			logs = []LogEntry{{Term: rec.LastIncludedTerm, Command: nil}}
+		case recordHardState:
+			currTerm = rec.Term
+			votedFor = rec.VotedFor
+		case recordLog:
+			i := rec.Index - lastIncludedIndex
+			if i < 1 || i > len(logs) {
+				return &CorruptStateError{0, fmt.Sprintf("log record at index %d leaves a gap", rec.Index)}
+			}
+			logs = append(logs[:i], rec.Entries...)
+		}
+	}
+
+	rf.currTerm = currTerm
+	rf.votedFor = votedFor
+	rf.logs = logs
+	rf.lastIncludedIndex = lastIncludedIndex
+	rf.lastIncludedTerm = lastIncludedTerm
+	rf.baseMembers = baseMembers
+	rf.baseLearners = baseLearners
+	return nil
+}
+
+// lastLogIndex returns the absolute index of the last entry in the log.
+func (rf *Raft) lastLogIndex() int {
+	return rf.lastIncludedIndex + len(rf.logs) - 1
+}
+
+// logAt returns the entry at absolute index i.
+// i must not be below lastIncludedIndex.
+func (rf *Raft) logAt(i int) LogEntry {
+	return rf.logs[i-rf.lastIncludedIndex]
+}
+
+// configAt returns the configuration (voters and learners) in effect at
+// absolute index i: the snapshot's configuration with every ConfigChange
+// up to i applied.
+func (rf *Raft) configAt(i int) ([]bool, []bool) {
+	members := make([]bool, len(rf.baseMembers))
+	copy(members, rf.baseMembers)
+	learners := make([]bool, len(rf.baseLearners))
+	copy(learners, rf.baseLearners)
+	for _, j := range rf.configs {
+		if j > i {
+			break
+		}
+		cc := rf.logAt(j).Command.(ConfigChange)
+		members[cc.Server] = cc.Op == ConfigAddServer
+		learners[cc.Server] = cc.Op == ConfigAddLearner
+	}
+	return members, learners
+}
+
+// updateConfig recomputes the configuration in effect from rf.configs,
+// after the log lost entries or got another base.
+func (rf *Raft) updateConfig() {
+	rf.members, rf.learners = rf.configAt(rf.lastLogIndex())
+	rf.configIndex = 0
+	if n := len(rf.configs); n > 0 {
+		rf.configIndex = rf.configs[n-1]
+	}
+
+	// a leader keeps leading until its own change commits, see startSendingHB()
+	if rf.raftState != Leader {
+		rf.stepDown()
+	}
+}
+
+// findConfigs looks through the whole log for its ConfigChanges, for when
+// the log is replaced wholesale: at start, and by an installed snapshot.
+func (rf *Raft) findConfigs() {
+	rf.configs = nil
+	for j := rf.lastIncludedIndex + 1; j <= rf.lastLogIndex(); j++ {
+		if _, ok := rf.logAt(j).Command.(ConfigChange); ok {
+			rf.configs = append(rf.configs, j)
+		}
+	}
+	rf.updateConfig()
+}
+
+// appendLog appends e to the log; a ConfigChange takes effect right away.
+func (rf *Raft) appendLog(e LogEntry) {
+	rf.logs = append(rf.logs, e)
+	cc, ok := e.Command.(ConfigChange)
+	if !ok {
+		return
+	}
+	rf.configIndex = rf.lastLogIndex()
+	rf.configs = append(rf.configs, rf.configIndex)
+	rf.members[cc.Server] = cc.Op == ConfigAddServer
+	rf.learners[cc.Server] = cc.Op == ConfigAddLearner
+	if rf.raftState != Leader {
+		rf.stepDown()
+	}
+}
+
+// stepDown makes me a follower, or a learner if that's my part in the configuration.
+func (rf *Raft) stepDown() {
+	if rf.learners[rf.me] {
+		rf.raftState = Learner
 	} else {
-		rf.currTerm = currTerm
-		rf.votedFor = votedFor
-		rf.logs = logs
+		rf.raftState = Follower
 	}
+	// let the replicators of a former leader exit
+	rf.replCond.Broadcast()
+	if rf.stopLeading != nil {
+		rf.stopLeading()
+	}
+}
+
+// followLeader makes me follow the leader of term, which is at least mine;
+// most calls from a leader change neither my state nor my term, and then
+// neither is touched.
+func (rf *Raft) followLeader(term int32) {
+	if rf.raftState == Leader || rf.raftState == Candidate {
+		rf.stepDown()
+	}
+	if term != rf.currTerm {
+		rf.currTerm = term
+		rf.persist()
+	}
+}
+
+// quorum is the number of votes (or matching logs) needed for a majority
+// of the configuration in effect.
+func (rf *Raft) quorum() int {
+	n := 0
+	for _, member := range rf.members {
+		if member {
+			n++
+		}
+	}
+	return n/2 + 1
+}
+
+// the service says it has created a snapshot that has
+// all info up to and including index. this means the
+// service no longer needs the log through (and including)
+// that index. Raft should now trim its log as much as possible.
+func (rf *Raft) Snapshot(index int, snapshot []byte) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	// ignore snapshots that are older than ours or that cover entries that
+	// aren't committed. the service may snapshot an entry as soon as it gets
+	// it, before the applier has counted it as applied, so don't hold it to
+	// lastApplied; it has applied everything up to index now
+	if index <= rf.lastIncludedIndex || index > rf.commitIndex {
+		return
+	}
+	if index > rf.lastApplied {
+		rf.lastApplied = index
+		rf.readCond.Broadcast()
+	}
+
+	lastIncludedTerm := rf.logAt(index).Term
+	baseMembers, baseLearners := rf.configAt(index)
+	rf.configs = rf.configs[sort.SearchInts(rf.configs, index+1):]
+	logs := make([]LogEntry, 1, rf.lastLogIndex()-index+1)
+	logs[0] = LogEntry{Term: lastIncludedTerm, Command: nil}
+	logs = append(logs, rf.logs[index-rf.lastIncludedIndex+1:]...)
+
+	rf.logs = logs
+	rf.lastIncludedIndex = index
+	rf.lastIncludedTerm = lastIncludedTerm
+	rf.baseMembers = baseMembers
+	rf.baseLearners = baseLearners
+	rf.snapshot = snapshot
+	rf.persistAll()
 }
 
 // example RequestVote RPC arguments structure.
@@ -145,6 +496,7 @@ type RequestVoteArgs struct {
 	CandId      int
 	LastLogIdx  int
 	LastLogTerm int
+	Transfer    bool // the leader asked the candidate to run (TimeoutNow), so it's not disrupting anyone
 }
 
 // example RequestVote RPC reply structure.
@@ -172,10 +524,25 @@ func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 		return
 	}
 
+	// servers outside my configuration (e.g. one that was just removed) can't disrupt the cluster
+	if !rf.members[args.CandId] {
+		reply.VoteGranted = false
+		reply.Term = rf.currTerm
+		return
+	}
+
+	// with leases, the leader I heard from recently may still be serving reads; don't help replace it yet
+	if rf.leaseRead && !args.Transfer && rf.raftState == Follower &&
+		rf.sim.Since(rf.lastContact) < electionTimeoutMin*time.Millisecond {
+		reply.VoteGranted = false
+		reply.Term = rf.currTerm
+		return
+	}
+
 	// if the requester term is more than me, it means that it is an election period; I grant the vote
 	if args.Term > rf.currTerm {
 		rf.currTerm = args.Term // reset my term to the new one
-		rf.raftState = Follower // reset my state to Follower until the election ends or I become a Candidate
+		rf.stepDown()           // reset my state to Follower until the election ends or I become a Candidate
 		rf.votedFor = -1        // reset my vote
 		rf.persist()
 	}
@@ -187,8 +554,8 @@ func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 		rf.persist()
 	}
 
-	lastLogIndex := len(rf.logs) - 1
-	lastLogTerm := int(rf.logs[lastLogIndex].Term)
+	lastLogIndex := rf.lastLogIndex()
+	lastLogTerm := int(rf.logAt(lastLogIndex).Term)
 
 	isCandidateLogNewer := (args.LastLogTerm > lastLogTerm) ||
 		(args.LastLogTerm == lastLogTerm && args.LastLogIdx >= lastLogIndex)
@@ -206,6 +573,34 @@ func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 
 }
 
+// PreVote asks whether I would vote for the candidate if it started an
+// election. args.Term is the term the candidate would campaign in; unlike
+// RequestVote, nothing about my state changes, so a candidate that can't
+// win doesn't disrupt anyone.
+func (rf *Raft) PreVote(args *RequestVoteArgs, reply *RequestVoteReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	reply.Term = rf.currTerm
+	reply.VoteGranted = false
+
+	if args.Term <= rf.currTerm || !rf.members[args.CandId] {
+		return
+	}
+
+	// I'm the leader, or have heard from one recently: there's no need for an election
+	if rf.raftState == Leader ||
+		rf.sim.Since(rf.lastContact) < electionTimeoutMin*time.Millisecond {
+		return
+	}
+
+	lastLogIndex := rf.lastLogIndex()
+	lastLogTerm := int(rf.logAt(lastLogIndex).Term)
+
+	reply.VoteGranted = (args.LastLogTerm > lastLogTerm) ||
+		(args.LastLogTerm == lastLogTerm && args.LastLogIdx >= lastLogIndex)
+}
+
 // example code to send a RequestVote RPC to a server.
 // server is the index of the target server in rf.peers[].
 // expects RPC arguments in args.
@@ -251,40 +646,157 @@ func (rf *Raft) sendRequestVote(server int, args *RequestVoteArgs, reply *Reques
 // term. the third return value is true if this server believes it is
 // the leader.
 func (rf *Raft) Start(command interface{}) (int, int, bool) {
+	index, _, term, isLeader := rf.StartBatch([]interface{}{command})
+	return index, term, isLeader
+}
+
+// StartBatch is like Start() for several commands at once. they get
+// consecutive indexes; it returns the first and the last of them, the
+// current term, and whether this server believes it is the leader.
+// an empty batch returns a last index below the first.
+func (rf *Raft) StartBatch(commands []interface{}) (int, int, int, bool) {
 	rf.mu.Lock()
+	defer rf.mu.Unlock()
 
-	index := -1
+	first, last := -1, -1
 	term := int(rf.currTerm)
-	isLeader := (rf.raftState == Leader)
+	// while handing leadership over, I stop taking new commands
+	isLeader := (rf.raftState == Leader) && rf.transferTarget < 0
 
 	if isLeader {
-		// if leader, append it to logs
-		// logs will be added alongside heartbeats to reduce RPC calls
-		rf.logs = append(rf.logs, LogEntry{Term: rf.currTerm, Command: command})
-		// rf.lastApplied += 1
-		index = len(rf.logs) - 1
-		rf.mu.Unlock()
+		// if leader, append them to logs; the replicators send them right away
+		first = rf.lastLogIndex() + 1
+		for _, command := range commands {
+			rf.appendLog(LogEntry{Term: rf.currTerm, Command: command})
+		}
+		last = rf.lastLogIndex()
+		// the flusher persists them, together with whatever else is started meanwhile
+		rf.flushCond.Signal()
+		rf.replCond.Broadcast()
+	}
 
-		rf.persist()
+	return first, last, term, isLeader
+}
 
-		// go rf.SendAllLogs()
-	} else {
-		rf.mu.Unlock()
+// AddServer asks the leader to add server (an index into peers[]) to the
+// configuration. RemoveServer asks it to take one out, which may be the
+// leader itself; it steps down after the change is committed.
+// only one change can be in progress at a time, so both return false if
+// this server isn't the leader, if the previous change hasn't been
+// committed yet, or if the change would do nothing. a new leader can't
+// tell whether an earlier leader's change is still to commit until it has
+// committed an entry of its own term, so they return false until then
+// too. otherwise they return the index and term of the ConfigChange
+// entry, like Start().
+func (rf *Raft) AddServer(server int) (int, int, bool) {
+	return rf.changeConfig(ConfigChange{Op: ConfigAddServer, Server: server}, false)
+}
+
+func (rf *Raft) RemoveServer(server int) (int, int, bool) {
+	return rf.changeConfig(ConfigChange{Op: ConfigRemoveServer, Server: server}, false)
+}
+
+// AddLearner adds server to the configuration as a learner, which gets
+// the log and applies it but doesn't vote or count towards commitment,
+// so it can catch up (or serve as a read replica) without affecting
+// quorum. PromoteLearner turns a learner into a voter, but only once it
+// has caught up with the commit index, so that adding it doesn't stall
+// commitment. both return like AddServer().
+func (rf *Raft) AddLearner(server int) (int, int, bool) {
+	return rf.changeConfig(ConfigChange{Op: ConfigAddLearner, Server: server}, false)
+}
+
+func (rf *Raft) PromoteLearner(server int) (int, int, bool) {
+	return rf.changeConfig(ConfigChange{Op: ConfigAddServer, Server: server}, true)
+}
+
+// changeConfig appends cc, if the leader can take it. a promotion also
+// needs cc.Server to be a learner that has caught up; that is checked
+// under the same lock, so it still holds when cc is appended.
+func (rf *Raft) changeConfig(cc ConfigChange, promote bool) (int, int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	term := int(rf.currTerm)
+	if rf.raftState != Leader || rf.transferTarget >= 0 || rf.configIndex > rf.commitIndex ||
+		rf.logAt(rf.commitIndex).Term != rf.currTerm ||
+		cc.Server < 0 || cc.Server >= len(rf.peers) ||
+		(rf.members[cc.Server] == (cc.Op == ConfigAddServer) &&
+			rf.learners[cc.Server] == (cc.Op == ConfigAddLearner)) ||
+		(promote && (!rf.learners[cc.Server] || rf.matchIndex[cc.Server] < rf.commitIndex)) {
+		return -1, term, false
 	}
 
-	return index, term, isLeader
+	rf.appendLog(LogEntry{Term: rf.currTerm, Command: cc})
+	index := rf.lastLogIndex()
+	rf.persist()
+	rf.replCond.Broadcast()
+
+	rf.logger.Log(0, "Config change %v at index %v", cc, index)
+	return index, term, true
+}
+
+// applier sends committed entries (and snapshots installed by the leader)
+// on applyCh. it runs in its own goroutine and releases the lock while
+// sending, so the service is free to call back into Raft (e.g. Snapshot())
+// while it handles an ApplyMsg.
+func (rf *Raft) applier() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	for !rf.killed() {
+		if rf.snapshotPending {
+			rf.snapshotPending = false
+			msg := ApplyMsg{
+				SnapshotValid: true,
+				Snapshot:      rf.snapshot,
+				SnapshotTerm:  int(rf.lastIncludedTerm),
+				SnapshotIndex: rf.lastIncludedIndex,
+			}
+			rf.mu.Unlock()
+			labsim.Send(rf.sim, rf.applyCh, msg)
+			rf.mu.Lock()
+			if msg.SnapshotIndex > rf.lastApplied {
+				rf.lastApplied = msg.SnapshotIndex
+			}
+			rf.readCond.Broadcast()
+		} else if rf.lastApplied < rf.commitIndex {
+			i := rf.lastApplied + 1
+			msg := ApplyMsg{
+				CommandValid: true,
+				Command:      rf.logAt(i).Command,
+				CommandIndex: i,
+			}
+			rf.mu.Unlock()
+			labsim.Send(rf.sim, rf.applyCh, msg)
+			rf.mu.Lock()
+			if i > rf.lastApplied {
+				rf.lastApplied = i
+			}
+			rf.readCond.Broadcast()
+		} else {
+			rf.applyCond.Wait()
+		}
+	}
 }
 
-func (rf *Raft) applyLogs() {
-	rf.logger.Log(0, "Applying logs for node %v with last applied %v and commit index %v", rf.me, rf.lastApplied, rf.commitIndex)
-	for i := rf.lastApplied + 1; i <= rf.commitIndex; i++ {
-		rf.applyCh <- ApplyMsg{
-			CommandValid: true,
-			Command:      rf.logs[i].Command,
-			CommandIndex: i,
+// flusher persists the entries Start() appends. while it encodes the
+// state, which takes time proportional to the log, further Start() calls
+// wait for the lock; the next write then covers all of them. until an
+// entry is persisted, I don't count myself as having it (see
+// advanceCommitIndex()), so it can't be committed on my account and then
+// lost in a crash.
+func (rf *Raft) flusher() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	for !rf.killed() {
+		if rf.persistedIndex < rf.lastLogIndex() {
+			rf.persist()
+			rf.advanceCommitIndex()
+		} else {
+			rf.flushCond.Wait()
 		}
-		rf.lastApplied = i
-		// rf.logger.Log(0, "Applied logs at commit index %v for node %v", rf.commitIndex, rf.me)
 	}
 }
 
@@ -353,10 +865,9 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArg, reply *AppendEntriesReply)
 	}
 
 	rf.heartbeat = true
-	rf.raftState = Follower
+	rf.lastContact = rf.sim.Now()
 	rf.leaderId = args.LeaderId
-	rf.currTerm = args.Term
-	rf.persist()
+	rf.followLeader(args.Term)
 
 	// commit index update, also apply logs that should be commited
 
@@ -376,14 +887,20 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArg, reply *AppendEntriesReply)
 	// 	reply.Success = true
 	// 	return
 	// }
-	if args.PrevLogIndex > (len(rf.logs) - 1) {
+	if args.PrevLogIndex < rf.lastIncludedIndex {
+		// the entries before our snapshot are already committed; tell the leader where our log starts
+		reply.Success = false
+		reply.NextIndex = rf.lastIncludedIndex + 1
+		reply.Reply = 2
+		return
+	} else if args.PrevLogIndex > rf.lastLogIndex() {
 		reply.Success = false
-		reply.NextIndex = len(rf.logs)
+		reply.NextIndex = rf.lastLogIndex() + 1
 		reply.Reply = 2
 		return
-	} else if rf.logs[args.PrevLogIndex].Term != int32(args.PrevLogTerm) {
+	} else if rf.logAt(args.PrevLogIndex).Term != int32(args.PrevLogTerm) {
 		lastIndex := args.PrevLogIndex
-		for lastIndex > 0 && rf.logs[lastIndex].Term != int32(args.PrevLogTerm) {
+		for lastIndex > rf.lastIncludedIndex && rf.logAt(lastIndex).Term != int32(args.PrevLogTerm) {
 			lastIndex--
 		}
 		reply.Success = false
@@ -397,14 +914,14 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArg, reply *AppendEntriesReply)
 	ind := args.PrevLogIndex + 1
 	for i, entry := range args.Entries {
 		// If we already have a log at this index but terms are different, delete everything after this point
-		if ind < len(rf.logs) {
-			if rf.logs[ind].Term != entry.Term {
-				rf.logs = rf.logs[:ind] // Delete conflicting logs
+		if ind <= rf.lastLogIndex() {
+			if rf.logAt(ind).Term != entry.Term {
+				rf.truncateLog(ind) // Delete conflicting logs
 				isLogModified = true
 			}
 		}
-		if ind >= len(rf.logs) {
-			rf.logs = append(rf.logs, entry) // Append new Entries
+		if ind > rf.lastLogIndex() {
+			rf.appendLog(entry) // Append new Entries
 			isLogModified = true
 
 		}
@@ -419,13 +936,16 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArg, reply *AppendEntriesReply)
 	if args.LeaderCommit > int32(rf.commitIndex) {
 		// rf.logger.Log(0, "Commit index: %v for node %v", rf.commitIndex, rf.me)
 		lastNewIndex := args.PrevLogIndex + len(args.Entries)
+		newCommitIndex := lastNewIndex
 		if int(args.LeaderCommit) < lastNewIndex {
-			rf.commitIndex = int(args.LeaderCommit)
-		} else {
-			rf.commitIndex = lastNewIndex
+			newCommitIndex = int(args.LeaderCommit)
+		}
+		// a stale or reordered RPC must never move the commit index backwards
+		if newCommitIndex > rf.commitIndex {
+			rf.commitIndex = newCommitIndex
+			rf.logger.Log(0, "apply log for follower: %v", rf.me)
+			rf.applyCond.Signal()
 		}
-		rf.logger.Log(0, "apply log for follower: %v", rf.me)
-		rf.applyLogs()
 	}
 
 	// rf.logger.Log(0, "Follower logs updated:")
@@ -447,6 +967,20 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArg, reply *AppendEntriesReply)
 func (rf *Raft) Kill() {
 	atomic.StoreInt32(&rf.dead, 1)
 	// Your code here, if desired.
+
+	// wake up the applier, flusher, replicators and any readers so they can
+	// exit. don't wait for rf.mu: checkStorage() calls Kill() holding it.
+	rf.sim.Go(func() {
+		rf.mu.Lock()
+		rf.applyCond.Broadcast()
+		rf.flushCond.Broadcast()
+		rf.replCond.Broadcast()
+		rf.readCond.Broadcast()
+		if rf.stopLeading != nil {
+			rf.stopLeading()
+		}
+		rf.mu.Unlock()
+	})
 }
 
 func (rf *Raft) killed() bool {
@@ -454,21 +988,47 @@ func (rf *Raft) killed() bool {
 	return z == 1
 }
 
-func (rf *Raft) callAppendEntry(args *AppendEntriesArg, reply *AppendEntriesReply, node int) {
-	// callers side of append entry
-	ok := rf.peers[node].Call("Raft.AppendEntries", args, reply)
-
-	rf.mu.Lock()
-	defer rf.mu.Unlock()
+// appendEntriesDone handles the outcome of an AppendEntries to node; ok
+// says whether there is a reply. token is the replicator's for the RPC, 0
+// if it is an empty one. called with rf.mu held, from collect().
+func (rf *Raft) appendEntriesDone(args *AppendEntriesArg, reply *AppendEntriesReply, ok bool, node int, hb hbStamp, token uint64) {
+	// RPCs with entries come from the replicator, which limits how many are outstanding
+	if rf.currTerm == args.Term && rf.inflight[node][token] {
+		delete(rf.inflight[node], token)
+		rf.replCond.Broadcast()
+	}
 
 	if ok && reply.Term > rf.currTerm {
 		// turn into follower if term is higher
-		rf.raftState = Follower
+		rf.stepDown()
 		rf.currTerm = reply.Term
 		rf.persist()
+		rf.readCond.Broadcast()
+		return
+	}
+
+	// the reply belongs to a term in which I was the leader, but I might not be anymore
+	if rf.raftState != Leader || rf.currTerm != args.Term {
 		return
 	}
 
+	if ok {
+		rf.ackHB(node, hb)
+		if len(args.Entries) == 0 && len(rf.inflight[node]) > 0 && hb.sent.After(rf.lastSentAt[node]) {
+			// the peer answered a HB sent after everything in flight, which is
+			// late or lost (e.g. it was disconnected); send again from what it
+			// has. replies that still come for those don't count anymore
+			rf.inflight[node] = map[uint64]bool{}
+			rf.nextIndex[node] = rf.matchIndex[node] + 1
+			rf.replCond.Broadcast()
+		}
+	} else if len(args.Entries) != 0 {
+		// the entries might not have made it; send them again from what the follower is known to have
+		if rf.nextIndex[node] > rf.matchIndex[node]+1 {
+			rf.nextIndex[node] = rf.matchIndex[node] + 1
+		}
+	}
+
 	if len(args.Entries) != 0 {
 		// print logs when not heartbeat
 		// rf.logger.Log(0, "Leader logs current")
@@ -482,41 +1042,88 @@ func (rf *Raft) callAppendEntry(args *AppendEntriesArg, reply *AppendEntriesRepl
 		if newMatchIndex > rf.matchIndex[node] {
 			rf.matchIndex[node] = newMatchIndex
 		}
-		rf.nextIndex[node] = rf.matchIndex[node] + 1
+		// nextIndex is ahead already if more entries are on their way
+		if rf.nextIndex[node] < rf.matchIndex[node]+1 {
+			rf.nextIndex[node] = rf.matchIndex[node] + 1
+		}
 	} else if ok && !reply.Success {
 		// decrement nextIndex and retry
 		if reply.Reply == 2 {
 			rf.nextIndex[node] = reply.NextIndex
-			go rf.callAppendEntry(args, reply, node)
+			if rf.nextIndex[node] < rf.matchIndex[node]+1 {
+				// a stale reply; the follower has everything up to matchIndex
+				rf.nextIndex[node] = rf.matchIndex[node] + 1
+			}
+			rf.replCond.Broadcast()
 		}
 		// rf.logger.Log(0, "Append Entry Failed:")
 		// rf.logger.Log(0, "Reply Next Index: %v", reply.NextIndex)
 	}
 
 	// we count for majority each time we get an append entry
-	for n := len(rf.logs) - 1; n >= rf.commitIndex; n-- {
-		if rf.logs[n].Term != rf.currTerm {
+	rf.advanceCommitIndex()
+
+	// print logs here to check
+}
+
+// advanceCommitIndex commits the highest entry of my term that a majority
+// of the configuration has.
+func (rf *Raft) advanceCommitIndex() {
+	if rf.raftState != Leader || rf.killed() {
+		return
+	}
+
+	for n := rf.lastLogIndex(); n >= rf.commitIndex; n-- {
+		if rf.logAt(n).Term != rf.currTerm {
 			continue
 		}
 
-		count := 1
+		count := 0
+		if rf.members[rf.me] && rf.persistedIndex >= n {
+			count = 1
+		}
 
-		if rf.logs[n].Term == rf.currTerm {
+		if rf.logAt(n).Term == rf.currTerm {
 			for i := 0; i < len(rf.peers); i++ {
-				if i != rf.me && rf.matchIndex[i] >= n {
+				if i != rf.me && rf.members[i] && rf.matchIndex[i] >= n {
 					count++
 				}
 			}
 		}
-		if count >= len(rf.peers)/2+1 && n != rf.commitIndex {
+		if count >= rf.quorum() && n != rf.commitIndex {
 			rf.commitIndex = n
 			rf.logger.Log(0, "New Commit index: %v for node %v", rf.commitIndex, rf.me)
-			rf.applyLogs()
+			rf.applyCond.Signal()
 			break
 		}
 	}
+	rf.sendCommit()
+}
 
-	// print logs here to check
+// replicationTargets returns the peers the leader sends entries to: the
+// members and learners, and a server being removed until it has seen the change.
+func (rf *Raft) replicationTargets() []int {
+	targets := []int{}
+	for i := range rf.peers {
+		if rf.isReplicationTarget(i) {
+			targets = append(targets, i)
+		}
+	}
+	return targets
+}
+
+func (rf *Raft) isReplicationTarget(i int) bool {
+	if i == rf.me {
+		return false
+	}
+	if rf.members[i] || rf.learners[i] {
+		return true
+	}
+	if rf.configIndex > rf.commitIndex {
+		cc := rf.logAt(rf.configIndex).Command.(ConfigChange)
+		return cc.Op == ConfigRemoveServer && cc.Server == i
+	}
+	return false
 }
 
 func (rf *Raft) printLogs(node int) {
@@ -525,60 +1132,284 @@ func (rf *Raft) printLogs(node int) {
 	// defer rf.mu.Unlock()
 	rf.logger.Log(0, "Logs of Node %v", node)
 	for i, log := range rf.logs {
-		rf.logger.Log(0, "	Index: %v, Term: %v, Command: %v", i, log.Term, log.Command)
+		rf.logger.Log(0, "	Index: %v, Term: %v, Command: %v", rf.lastIncludedIndex+i, log.Term, log.Command)
+	}
+}
+
+type InstallSnapshotArgs struct {
+	Term              int32
+	LeaderId          int
+	LastIncludedIndex int
+	LastIncludedTerm  int32
+	Members           []bool // configuration as of LastIncludedIndex
+	Learners          []bool
+	Offset            int    // of Data in the snapshot
+	Size              int    // of the whole snapshot
+	Data              []byte // a chunk of it
+}
+
+type InstallSnapshotReply struct {
+	Term      int32
+	Installed bool // I have everything the snapshot covers
+	Next      int  // otherwise, how much of the snapshot I have from its start
+}
+
+// InstallSnapshot is invoked by the leader to send a follower the snapshot
+// when the entries the follower needs have already been compacted away.
+// the snapshot comes in chunks, which may arrive in any order (see
+// sendSnapshot()); the follower gathers them, and installs the snapshot
+// once it has them all.
+func (rf *Raft) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	reply.Term = rf.currTerm
+	if args.Term < rf.currTerm {
+		return
+	}
+
+	rf.heartbeat = true
+	rf.lastContact = rf.sim.Now()
+	rf.leaderId = args.LeaderId
+	rf.followLeader(args.Term)
+
+	// everything in the snapshot is already committed here (or an older snapshot); nothing to do
+	if args.LastIncludedIndex <= rf.commitIndex {
+		reply.Installed = true
+		return
+	}
+	data, next, ok := rf.gatherSnapshot(args)
+	if !ok {
+		reply.Next = next
+		return
+	}
+	reply.Installed = true
+
+	// keep the entries following the snapshot if our log agrees with it, otherwise discard the whole log
+	logs := []LogEntry{{Term: args.LastIncludedTerm, Command: nil}}
+	if args.LastIncludedIndex < rf.lastLogIndex() && rf.logAt(args.LastIncludedIndex).Term == args.LastIncludedTerm {
+		logs = append(logs, rf.logs[args.LastIncludedIndex-rf.lastIncludedIndex+1:]...)
+	}
+
+	rf.logs = logs
+	rf.lastIncludedIndex = args.LastIncludedIndex
+	rf.lastIncludedTerm = args.LastIncludedTerm
+	rf.baseMembers = args.Members
+	rf.baseLearners = args.Learners
+	rf.findConfigs()
+	rf.snapshot = data
+	rf.commitIndex = args.LastIncludedIndex
+	rf.snapshotPending = true
+	rf.persistAll()
+
+	rf.applyCond.Signal()
+}
+
+// partialSnapshot is a snapshot from the leader of term, covering up to
+// index, that has only come in part.
+type partialSnapshot struct {
+	term   int32
+	index  int
+	data   []byte
+	chunks map[int]int // the lengths of the chunks that came, by offset
+	next   int         // the chunks from the start up to here came
+}
+
+// gatherSnapshot keeps the chunk in args, and returns the whole snapshot
+// once all of its chunks are there; until then, how much of it has come
+// from its start. chunks of another snapshot than the one being gathered
+// start over.
+func (rf *Raft) gatherSnapshot(args *InstallSnapshotArgs) ([]byte, int, bool) {
+	if args.Offset == 0 && len(args.Data) == args.Size {
+		return args.Data, args.Size, true
+	}
+	if args.Offset < 0 || len(args.Data) == 0 || args.Offset+len(args.Data) > args.Size {
+		return nil, 0, false
+	}
+
+	p := rf.incoming
+	if p == nil || p.term != args.Term || p.index != args.LastIncludedIndex || len(p.data) != args.Size {
+		p = &partialSnapshot{
+			term:   args.Term,
+			index:  args.LastIncludedIndex,
+			data:   make([]byte, args.Size),
+			chunks: map[int]int{},
+		}
+		rf.incoming = p
+	}
+	// a chunk may come twice, or out of order
+	p.chunks[args.Offset] = copy(p.data[args.Offset:], args.Data)
+	for p.chunks[p.next] > 0 {
+		p.next += p.chunks[p.next]
+	}
+	if p.next < args.Size {
+		return nil, p.next, false
+	}
+	rf.incoming = nil
+	return p.data, p.next, true
+}
+
+// snapshotOffset says that a peer has the first off bytes of the snapshot
+// up to index.
+type snapshotOffset struct {
+	index int
+	off   int
+}
+
+// snapshotDone handles the replies to the chunks of a snapshot sent to
+// node, args being the first chunk. called with rf.mu held, from
+// sendSnapshot().
+func (rf *Raft) snapshotDone(args *InstallSnapshotArgs, replies []*InstallSnapshotReply, node int, hb hbStamp, token uint64) {
+	if rf.currTerm == args.Term && rf.inflight[node][token] {
+		delete(rf.inflight[node], token)
+		rf.replCond.Broadcast()
+	}
+
+	installed, answered, next := false, false, 0
+	for _, reply := range replies {
+		if reply.Term > rf.currTerm {
+			// turn into follower if term is higher
+			rf.stepDown()
+			rf.currTerm = reply.Term
+			rf.persist()
+			rf.readCond.Broadcast()
+			return
+		}
+		installed = installed || reply.Installed
+		// a reply that didn't come is left with Term 0
+		if reply.Term != 0 {
+			answered = true
+			if reply.Next > next {
+				next = reply.Next
+			}
+		}
+	}
+
+	if rf.raftState != Leader || rf.currTerm != args.Term {
+		return
+	}
+	if !installed {
+		// a chunk didn't make it, or the peer lost the ones it had in a crash; send it again,
+		// from where the peer has it up to
+		if answered {
+			rf.snapshotNext[node] = snapshotOffset{args.LastIncludedIndex, next}
+		}
+		if rf.nextIndex[node] > rf.matchIndex[node]+1 {
+			rf.nextIndex[node] = rf.matchIndex[node] + 1
+		}
+		return
+	}
+	rf.ackHB(node, hb)
+
+	if args.LastIncludedIndex > rf.matchIndex[node] {
+		rf.matchIndex[node] = args.LastIncludedIndex
+	}
+	if rf.nextIndex[node] < rf.matchIndex[node]+1 {
+		rf.nextIndex[node] = rf.matchIndex[node] + 1
 	}
 }
 
 func (rf *Raft) startSendingHB() {
 
 	// check if I'm still the leader before sending HBs
-	for !rf.killed() && rf.raftState == Leader {
+	for !rf.killed() {
 		rf.mu.Lock()
+		if rf.raftState != Leader {
+			rf.mu.Unlock()
+			return
+		}
 		currTerm := rf.currTerm
-		leaderId := rf.me
+		rf.hbRound++
+		targets := rf.replicationTargets()
+		// nobody might be left to reply, e.g. in a configuration of one
+		rf.advanceCommitIndex()
+		// once my removal is committed, this round of HBs tells the others and then I step down
+		removed := !rf.members[rf.me] && rf.configIndex <= rf.commitIndex
+		for _, i := range targets {
+			// the HBs are for idle peers; the replicator's RPCs do for the busy ones
+			if !removed && rf.sim.Since(rf.lastSentAt[i]) < hbInterval {
+				continue
+			}
+			rf.sendEmpty(i, currTerm)
+
+			// if logs, check if append entries result is majority and choose to commit
+			// after each accept, check for majority and commit index
+		}
 		rf.mu.Unlock()
-		for i := range rf.peers {
-			if i != rf.me {
-				go func(i int) {
-					rf.mu.Lock()
-					prevInd := rf.nextIndex[i] - 1
-					prevLog := int(rf.logs[prevInd].Term)
-					entries := rf.logs[rf.nextIndex[i]:]
-					rf.mu.Unlock()
-
-					args := &AppendEntriesArg{
-						Term:         currTerm,
-						LeaderId:     leaderId,
-						PrevLogIndex: prevInd,
-						PrevLogTerm:  prevLog,
-						Entries:      make([]LogEntry, len(entries)),
-						LeaderCommit: int32(rf.commitIndex),
-					}
-					copy(args.Entries, entries) // copy the logs from nextIndex
-
-					reply := &AppendEntriesReply{}
-					// ok := rf.peers[i].Call("Raft.AppendEntries", args, reply)
-					go rf.callAppendEntry(args, reply, i)
-
-					// rf.mu.Lock()
-					// if ok && reply.Term > rf.currTerm {
-					// 	rf.raftState = Follower
-					// 	rf.currTerm = reply.Term
-					// }
-					// rf.mu.Unlock()
-				}(i)
-
-				// if logs, check if append entries result is majority and choose to commit
-				// after each accept, check for majority and commit index
+		rf.sim.Sleep(hbInterval)
 
+		if removed {
+			rf.mu.Lock()
+			if rf.currTerm == currTerm {
+				rf.stepDown()
 			}
+			rf.mu.Unlock()
+			return
+		}
+	}
+}
+
+// winPreVote asks the members whether I could win an election in the
+// next term, without changing anyone's state.
+func (rf *Raft) winPreVote() bool {
+	rf.mu.Lock()
+	if rf.raftState == Leader || !rf.members[rf.me] {
+		rf.mu.Unlock()
+		return false
+	}
+
+	args := &RequestVoteArgs{}
+	args.Term = rf.currTerm + 1
+	args.CandId = rf.me
+	args.LastLogIdx = rf.lastLogIndex()
+	args.LastLogTerm = int(rf.logAt(args.LastLogIdx).Term)
+
+	members := make([]bool, len(rf.members))
+	copy(members, rf.members)
+	majority := rf.quorum()
+	rf.mu.Unlock()
+
+	// buffered, so the replies I don't wait for don't leave goroutines behind
+	voteCh := make(chan *labrpc.AsyncCall, len(rf.peers))
+
+	gotVotes := 1
+	recVotes := 1
+	voters := 0
+	for _, member := range members {
+		if member {
+			voters++
+		}
+	}
+
+	for i := 0; i < len(rf.peers); i += 1 {
+		if i != rf.me && members[i] {
+			rf.peers[i].Go("Raft.PreVote", args, &RequestVoteReply{}, voteCh)
+		}
+	}
+
+	for gotVotes < majority && recVotes < voters {
+		if c, _ := labsim.Recv(rf.sim, voteCh); voteGranted(c) {
+			gotVotes += 1
 		}
-		time.Sleep(100 * time.Millisecond)
+		recVotes += 1
 	}
+
+	return gotVotes >= majority
+}
+
+// whether the RequestVote or PreVote call c got the vote.
+func voteGranted(c *labrpc.AsyncCall) bool {
+	return c.Error == nil && c.Reply.(*RequestVoteReply).VoteGranted
 }
 
 // startEelction starts an election
-func (rf *Raft) startElection() {
+// transfer is set when the leader handed leadership to me (TimeoutNow)
+func (rf *Raft) startElection(transfer bool) {
+	// with pre-vote, only bump my term if a majority would vote for me
+	if rf.preVote && !transfer && !rf.winPreVote() {
+		return
+	}
+
 	// starting a new election
 	rf.mu.Lock()
 
@@ -589,6 +1420,12 @@ func (rf *Raft) startElection() {
 		return
 	}
 
+	// servers outside the configuration don't take part in elections
+	if !rf.members[rf.me] {
+		rf.mu.Unlock()
+		return
+	}
+
 	// 0. transition to the Candidate state
 	rf.raftState = Candidate
 
@@ -604,18 +1441,30 @@ func (rf *Raft) startElection() {
 	args := &RequestVoteArgs{}
 	args.Term = rf.currTerm
 	args.CandId = rf.me
-	args.LastLogIdx = len(rf.logs) - 1
-	args.LastLogTerm = int(rf.logs[args.LastLogIdx].Term)
+	args.LastLogIdx = rf.lastLogIndex()
+	args.LastLogTerm = int(rf.logAt(args.LastLogIdx).Term)
+	args.Transfer = transfer
+
+	// only the members of the configuration in effect get a vote
+	members := make([]bool, len(rf.members))
+	copy(members, rf.members)
+	majority := rf.quorum() // majority is the threshold for winning the current election
 
 	rf.mu.Unlock()
 
 	// should ask the peers in parallel for their vote;
-	// so we'll wait on this channel after sending the requests in parallel
-	voteCh := make(chan bool)
-
-	gotVotes := 1                   // gotVotes counts granted votes for me in this round of election; counted my vote already
-	majority := len(rf.peers)/2 + 1 // majority is the threshold for winning the current election
-	recVotes := 1                   // recVotes counts all peers voted (mine counted); in case we haven't reached a majority of votes
+	// so we'll wait on this channel after sending the requests in parallel;
+	// buffered, so the replies I don't wait for don't leave goroutines behind
+	voteCh := make(chan *labrpc.AsyncCall, len(rf.peers))
+
+	gotVotes := 1 // gotVotes counts granted votes for me in this round of election; counted my vote already
+	recVotes := 1 // recVotes counts all peers voted (mine counted); in case we haven't reached a majority of votes
+	voters := 0   // voters is the number of members, including me
+	for _, member := range members {
+		if member {
+			voters++
+		}
+	}
 
 	// asking peers to vote until
 	// 1. I win!
@@ -623,18 +1472,14 @@ func (rf *Raft) startElection() {
 	// 3. another timeout happens
 	for i := 0; i < len(rf.peers); i += 1 {
 		// skip asking myself - already voted
-		if i != rf.me {
-			go func(i int) {
-				reply := &RequestVoteReply{}
-				ok := rf.sendRequestVote(i, args, reply)
-				voteCh <- ok && reply.VoteGranted
-			}(i)
+		if i != rf.me && members[i] {
+			rf.peers[i].Go("Raft.RequestVote", args, &RequestVoteReply{}, voteCh)
 		}
 	}
 
 	// let's count the votes
-	for gotVotes < majority && recVotes < len(rf.peers) {
-		if <-voteCh {
+	for gotVotes < majority && recVotes < voters {
+		if c, _ := labsim.Recv(rf.sim, voteCh); voteGranted(c) {
 			gotVotes += 1
 		}
 		recVotes += 1
@@ -656,19 +1501,56 @@ func (rf *Raft) startElection() {
 		rf.mu.Lock()
 		rf.raftState = Leader
 		rf.leaderId = rf.me
-		rf.mu.Unlock()
+		rf.transferTarget = -1
 
 		// RESET nextIndex and matchIndex
 		rf.nextIndex = make([]int, len(rf.peers))
 		rf.matchIndex = make([]int, len(rf.peers))
+		rf.hbAcked = make([]uint64, len(rf.peers))
+		rf.hbAckedAt = make([]time.Time, len(rf.peers))
+
+		rf.inflight = make([]map[uint64]bool, len(rf.peers))
+		for i := range rf.inflight {
+			rf.inflight[i] = map[uint64]bool{}
+		}
+		rf.lastSentAt = make([]time.Time, len(rf.peers))
+		rf.sentCommit = make([]int, len(rf.peers))
+		rf.snapshotNext = make([]snapshotOffset, len(rf.peers))
+		rf.leading, rf.stopLeading = context.WithCancel(context.Background())
 
-		lastIndex := len(rf.logs) - 1
+		lastIndex := rf.lastLogIndex()
 		for i := range rf.peers {
 			rf.nextIndex[i] = lastIndex + 1
 		}
 
+		// I can only commit entries of my term, and won't take another config
+		// change until the pending one commits; so propose the pending one again
+		if rf.configIndex > rf.commitIndex && rf.logAt(rf.configIndex).Term != rf.currTerm {
+			cc := rf.logAt(rf.configIndex).Command.(ConfigChange)
+			rf.appendLog(LogEntry{Term: rf.currTerm, Command: cc})
+			rf.persist()
+			rf.logger.Log(0, "Config change %v at index %v, again", cc, rf.lastLogIndex())
+		}
+
+		// start a replicator per peer; they send entries as soon as Start() appends them
+		rf.out = make([]*peerRPCs, len(rf.peers))
+		for i := range rf.peers {
+			if i != rf.me {
+				i, term := i, rf.currTerm
+				out := &peerRPCs{
+					done:  make(chan *labrpc.AsyncCall, rf.maxInflight+1),
+					calls: map[*labrpc.AsyncCall]rpcStamp{},
+				}
+				rf.out[i] = out
+				stop := rf.leading.Done()
+				rf.sim.Go(func() { rf.replicator(i, term) })
+				rf.sim.Go(func() { rf.collect(i, out, stop) })
+			}
+		}
+		rf.mu.Unlock()
+
 		// start sending HBs
-		go rf.startSendingHB()
+		rf.sim.Go(rf.startSendingHB)
 	}
 }
 
@@ -680,16 +1562,18 @@ func (rf *Raft) ticker() {
 		// Check if a leader election should be started.
 
 		// avoid the first vote split in the first round of election
-		ms = 350 + (rand.Int63() % 150)
-		time.Sleep(time.Duration(ms) * time.Millisecond)
+		ms = electionTimeoutMin + (rf.sim.Int63() % electionTimeoutSpan)
+		rf.sim.Sleep(time.Duration(ms) * time.Millisecond)
 
 		// check if we got a heartbeat from the leader
 		// if we haven't recieved any hearts; start an election
+		rf.mu.Lock()
 		if !rf.heartbeat {
-			go rf.startElection()
+			rf.sim.Go(func() { rf.startElection(false) })
 		}
 		// reset the heartbeat
 		rf.heartbeat = false
+		rf.mu.Unlock()
 
 	}
 }
@@ -702,9 +1586,23 @@ func (rf *Raft) ticker() {
 // recent saved state, if any. applyCh is a channel on which the
 // tester or service expects Raft to send ApplyMsg messages.
 // Make() must return quickly, so it should start goroutines
-// for any long-running work.
+// for any long-running work. it panics if the persisted state is
+// corrupt; MakeWithOptions() returns the error instead.
 func Make(peers []*labrpc.ClientEnd, me int,
-	persister *Persister, applyCh chan ApplyMsg) *Raft {
+	persister Storage, applyCh chan ApplyMsg) *Raft {
+	rf, err := MakeWithOptions(peers, me, persister, applyCh, Options{})
+	if err != nil {
+		panic(err)
+	}
+	return rf
+}
+
+// MakeWithOptions is like Make() but lets the caller tune the peer with
+// opts. it refuses to start from a corrupt persisted state, rather than
+// start over and forget its term and vote, and returns a *CorruptStateError
+// (errors.Is(err, ErrCorruptState)) instead.
+func MakeWithOptions(peers []*labrpc.ClientEnd, me int,
+	persister Storage, applyCh chan ApplyMsg, opts Options) (*Raft, error) {
 
 	// Your initialization code here (4A, 4B, 4C).
 	rf := &Raft{
@@ -713,29 +1611,78 @@ func Make(peers []*labrpc.ClientEnd, me int,
 		persister:   persister,
 		me:          me,
 		logger:      logger.NewLogger(me+1, true, fmt.Sprintf("raft-%d", me), constants.RaftLoggingMap),
+		sim:         opts.Sim,
 		dead:        0,
 		leaderId:    -1,
 		raftState:   Follower,
 		currTerm:    0,
 		votedFor:    -1,
 		heartbeat:   false,
+		preVote:     opts.PreVote,
+		leaseRead:   opts.LeaseRead,
+		clockDrift:  opts.ClockDrift,
 		logs:        make([]LogEntry, 0),
 		commitIndex: 0,
 		lastApplied: 0,
 		applyCh:     applyCh,
+
+		transferTarget: -1,
 	}
 
 	rf.logs = append(rf.logs, LogEntry{Term: 0, Command: nil})
+	rf.applyCond = labsim.NewCond(rf.sim, &rf.mu)
+	rf.flushCond = labsim.NewCond(rf.sim, &rf.mu)
+	rf.readCond = labsim.NewCond(rf.sim, &rf.mu)
+	rf.replCond = labsim.NewCond(rf.sim, &rf.mu)
+
+	rf.maxEntries = opts.MaxEntriesPerAppend
+	if rf.maxEntries <= 0 {
+		rf.maxEntries = defaultMaxEntriesPerAppend
+	}
+	rf.maxInflight = opts.MaxInflightAppends
+	if rf.maxInflight <= 0 {
+		rf.maxInflight = defaultMaxInflightAppends
+	}
+	rf.snapshotChunk = opts.SnapshotChunkSize
+	if rf.snapshotChunk <= 0 {
+		rf.snapshotChunk = defaultSnapshotChunkSize
+	}
+
+	rf.baseMembers = make([]bool, len(peers))
+	rf.baseLearners = make([]bool, len(peers))
+	for i := range peers {
+		rf.baseMembers[i] = opts.Members == nil
+	}
+	for _, i := range opts.Members {
+		rf.baseMembers[i] = true
+	}
 
 	// initialize from state persisted before a crash
-	rf.readPersist(persister.ReadRaftState())
+	if err := rf.readPersist(persister.ReadRaftState()); err != nil {
+		return nil, err
+	}
+	rf.findConfigs()
+
+	// the service restores itself from the snapshot, so start applying after it
+	rf.snapshot = persister.ReadSnapshot()
+	rf.commitIndex = rf.lastIncludedIndex
+	rf.lastApplied = rf.lastIncludedIndex
+
+	// start over with a compact copy of the state
+	rf.persistAll()
 
 	rf.logger.Log(constants.LogRaftStart, "Raft server started")
 
 	// start ticker goroutine to start elections
-	go rf.ticker()
+	rf.sim.Go(rf.ticker)
 
-	return rf
+	// start applier goroutine to send committed entries on applyCh
+	rf.sim.Go(rf.applier)
+
+	// start flusher goroutine to persist the entries Start() appends
+	rf.sim.Go(rf.flusher)
+
+	return rf, nil
 }
 
 // test fail agree
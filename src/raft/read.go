@@ -0,0 +1,226 @@
+package raft
+
+//
+// linearizable reads that don't go through the log.
+//
+// rf.ReadIndex(ctx) (index, err)
+//   wait until it is safe for the service to answer a read from its
+//   state machine, without appending a log entry for it.
+// rf.LeaseRead() (index, ok)
+//   with Options.LeaseRead, check whether the leader's lease lets it
+//   answer a read right away.
+//
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"lab4/labsim"
+)
+
+var (
+	ErrNotLeader      = errors.New("raft: not the leader")
+	ErrNoCommitInTerm = errors.New("raft: leader hasn't committed an entry in its term yet")
+	ErrKilled         = errors.New("raft: killed")
+)
+
+// ReadIndex implements the read-only queries of the Raft dissertation
+// (section 6.4). the leader remembers its commit index, sends a round of
+// HBs to make sure a majority still follows it, and then waits for the
+// service to apply everything up to that index. once it returns, the
+// state machine reflects every write that completed before ReadIndex was
+// called, so a read served from it is linearizable.
+//
+// it returns the read index on success; ErrNotLeader if this server isn't
+// (or stops being) the leader; ErrNoCommitInTerm if the leader hasn't
+// committed anything in its term yet, so it can't know the commit index
+// (Start() any command and retry); or ctx.Err() if ctx is done first.
+func (rf *Raft) ReadIndex(ctx context.Context) (int, error) {
+	rf.mu.Lock()
+	if rf.raftState != Leader {
+		rf.mu.Unlock()
+		return -1, ErrNotLeader
+	}
+	if rf.logAt(rf.commitIndex).Term != rf.currTerm {
+		rf.mu.Unlock()
+		return -1, ErrNoCommitInTerm
+	}
+
+	readIndex := rf.commitIndex
+	term := rf.currTerm
+	if rf.leaseValid() {
+		// a majority has acknowledged me recently enough; skip the round of HBs
+		rf.mu.Unlock()
+		err := rf.waitUntil(ctx, func() error {
+			if rf.lastApplied < readIndex {
+				return errNotYet
+			}
+			return nil
+		})
+		if err != nil {
+			return -1, err
+		}
+		return readIndex, nil
+	}
+	rf.hbRound++
+	round := rf.hbRound
+	for _, i := range rf.replicationTargets() {
+		rf.sendEmpty(i, term)
+	}
+	rf.mu.Unlock()
+
+	err := rf.waitUntil(ctx, func() error {
+		if rf.raftState != Leader || rf.currTerm != term {
+			return ErrNotLeader
+		}
+		if rf.ackedBy(round) < rf.quorum() {
+			return errNotYet
+		}
+		if rf.lastApplied < readIndex {
+			return errNotYet
+		}
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+	return readIndex, nil
+}
+
+// errNotYet tells waitUntil to keep waiting.
+var errNotYet = errors.New("not yet")
+
+// waitUntil blocks until check (called with rf.mu held) returns something
+// other than errNotYet, and returns that. it gives up with ctx.Err() when
+// ctx is done, or ErrKilled when Kill() is called. check is re-evaluated
+// whenever readCond is broadcast.
+//
+// in a simulation, ctx's deadline would pass on the real clock, at no
+// particular point of the run; the time left until it runs out on the
+// virtual clock instead, and only ctx being canceled counts as it is.
+func (rf *Raft) waitUntil(ctx context.Context, check func() error) error {
+	wake := ctx.Done()
+	expired := ctx.Err
+	if deadline, ok := ctx.Deadline(); ok && rf.sim != nil {
+		timeout := rf.sim.After(time.Until(deadline))
+		wake = timeout
+		expired = func() error {
+			select {
+			case <-timeout:
+				return context.DeadlineExceeded
+			default:
+			}
+			if ctx.Err() == context.Canceled {
+				return ctx.Err()
+			}
+			return nil
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	rf.sim.Go(func() {
+		if _, got := labsim.RecvOr(rf.sim, wake, done); got {
+			rf.mu.Lock()
+			rf.readCond.Broadcast()
+			rf.mu.Unlock()
+		}
+	})
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	for {
+		if rf.killed() {
+			return ErrKilled
+		}
+		if err := expired(); err != nil {
+			return err
+		}
+		if err := check(); err != errNotYet {
+			return err
+		}
+		rf.readCond.Wait()
+	}
+}
+
+// LeaseRead reports whether this server is the leader and holds a valid
+// lease (Options.LeaseRead), in which case the service may answer a read
+// from its state machine as soon as it has applied the returned index.
+//
+// the lease starts when a round of HBs that a majority acknowledges is
+// sent, and lasts for the minimum election timeout less the clock drift
+// bound: followers refuse to vote for anyone else for the minimum
+// election timeout after hearing from the leader, so no other leader can
+// be elected in the meantime.
+func (rf *Raft) LeaseRead() (int, bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.raftState != Leader || !rf.leaseValid() ||
+		rf.logAt(rf.commitIndex).Term != rf.currTerm {
+		return -1, false
+	}
+	return rf.commitIndex, true
+}
+
+// leaseValid says whether I'm a leader with an unexpired lease.
+func (rf *Raft) leaseValid() bool {
+	// once I've asked someone to take over, they won't wait for my lease to run out
+	if !rf.leaseRead || rf.raftState != Leader || rf.transferTarget >= 0 {
+		return false
+	}
+
+	// the lease starts when the latest round a majority (me included) acknowledged was sent
+	acked := []time.Time{}
+	for i, member := range rf.members {
+		if member && i != rf.me {
+			acked = append(acked, rf.hbAckedAt[i])
+		}
+	}
+	need := rf.quorum()
+	if rf.members[rf.me] {
+		need--
+	}
+	if need == 0 {
+		return true
+	}
+	if need > len(acked) {
+		return false
+	}
+	sort.Slice(acked, func(a, b int) bool { return acked[a].After(acked[b]) })
+	start := acked[need-1]
+
+	lease := electionTimeoutMin*time.Millisecond - rf.clockDrift
+	return rf.sim.Since(start) < lease
+}
+
+// hbStamp identifies the round of HBs an RPC was sent in, and when.
+type hbStamp struct {
+	round uint64
+	sent  time.Time
+}
+
+// ackHB records that peer i answered a round of HBs in my current term.
+func (rf *Raft) ackHB(i int, hb hbStamp) {
+	if hb.sent.After(rf.hbAckedAt[i]) {
+		rf.hbAckedAt[i] = hb.sent
+	}
+	if hb.round > rf.hbAcked[i] {
+		rf.hbAcked[i] = hb.round
+		rf.readCond.Broadcast()
+	}
+}
+
+// ackedBy counts the members, including me, that have answered round
+// (or a later one) of HBs in my current term.
+func (rf *Raft) ackedBy(round uint64) int {
+	n := 0
+	for i, member := range rf.members {
+		if member && (i == rf.me || rf.hbAcked[i] >= round) {
+			n++
+		}
+	}
+	return n
+}
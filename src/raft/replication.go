@@ -0,0 +1,234 @@
+package raft
+
+//
+// the leader's side of log replication.
+//
+// each peer gets a replicator goroutine for as long as I'm the leader. it
+// sends new entries as soon as Start() appends them instead of waiting for
+// the next HB, caps the entries per AppendEntries (maxEntries) and the
+// RPCs outstanding to the peer (maxInflight), and advances nextIndex as
+// soon as it sends, so the next batch can go out before the last one is
+// acknowledged. appendEntriesDone() moves nextIndex back if an RPC fails, or
+// if the peer answers a HB while the RPCs in flight don't come back; it
+// then gives up on those. each RPC has a token in rf.inflight until its
+// reply comes or it is given up on, so a reply that comes after all
+// doesn't count for a newer RPC. they all go out with rf.leading, which
+// stepDown() cancels, so a former leader doesn't wait on replies it has
+// no use for anymore.
+//
+// the AppendEntries go out with labrpc's Go(), and come back on a done
+// channel per peer, where collect() handles the replies; nothing else
+// waits on them. a snapshot goes out in chunks over a labrpc stream, by
+// sendSnapshot(), which waits for the stream to have room, and counts as
+// one RPC in flight.
+//
+// startSendingHB() only sends empty AppendEntries, through sendEmpty(), to
+// keep followers from starting elections when there's nothing to
+// replicate; a peer the replicator has sent something within hbInterval
+// gets none.
+// sendCommit() sends one as soon as the commit index moves, to the peers
+// with nothing in flight to tell them, so they don't wait for the next HB
+// to apply what's committed.
+//
+
+import (
+	"context"
+
+	"lab4/labrpc"
+	"lab4/labsim"
+)
+
+// replicator sends peer i the entries it's missing for as long as I'm the
+// leader in term.
+func (rf *Raft) replicator(i int, term int32) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	for !rf.killed() && rf.raftState == Leader && rf.currTerm == term {
+		if rf.hasEntriesFor(i) {
+			rf.sendEntries(i, term)
+		} else {
+			rf.replCond.Wait()
+		}
+	}
+}
+
+// hasEntriesFor says whether the replicator can send peer i something now.
+func (rf *Raft) hasEntriesFor(i int) bool {
+	if !rf.isReplicationTarget(i) || rf.nextIndex[i] > rf.lastLogIndex() ||
+		len(rf.inflight[i]) >= rf.maxInflight {
+		return false
+	}
+	// only one snapshot at a time; it replaces everything else in flight
+	if rf.nextIndex[i] <= rf.lastIncludedIndex && len(rf.inflight[i]) > 0 {
+		return false
+	}
+	return true
+}
+
+// sendEntries sends peer i up to maxEntries entries starting at nextIndex,
+// or the snapshot if those have been compacted, and moves nextIndex past
+// them. called with rf.mu held.
+func (rf *Raft) sendEntries(i int, term int32) {
+	hb := hbStamp{round: rf.hbRound, sent: rf.sim.Now()}
+	rf.lastToken++
+	token := rf.lastToken
+	rf.inflight[i][token] = true
+	rf.lastSentAt[i] = hb.sent
+
+	if rf.nextIndex[i] <= rf.lastIncludedIndex {
+		args := InstallSnapshotArgs{
+			Term:              term,
+			LeaderId:          rf.me,
+			LastIncludedIndex: rf.lastIncludedIndex,
+			LastIncludedTerm:  rf.lastIncludedTerm,
+			Members:           rf.baseMembers,
+			Learners:          rf.baseLearners,
+			Size:              len(rf.snapshot),
+		}
+		rf.nextIndex[i] = rf.lastIncludedIndex + 1
+
+		from := 0
+		if p := rf.snapshotNext[i]; p.index == rf.lastIncludedIndex && p.off < len(rf.snapshot) {
+			from = p.off
+		}
+		ctx, data := rf.leading, rf.snapshot
+		rf.sim.Go(func() { rf.sendSnapshot(ctx, args, data, from, i, hb, token) })
+		return
+	}
+
+	prevInd := rf.nextIndex[i] - 1
+	prevLog := int(rf.logAt(prevInd).Term)
+	entries := rf.logs[rf.nextIndex[i]-rf.lastIncludedIndex:]
+	if len(entries) > rf.maxEntries {
+		entries = entries[:rf.maxEntries]
+	}
+
+	args := &AppendEntriesArg{
+		Term:         term,
+		LeaderId:     rf.me,
+		PrevLogIndex: prevInd,
+		PrevLogTerm:  prevLog,
+		Entries:      make([]LogEntry, len(entries)),
+		LeaderCommit: int32(rf.commitIndex),
+	}
+	copy(args.Entries, entries) // copy the logs from nextIndex
+	rf.nextIndex[i] += len(entries)
+	rf.sentCommit[i] = rf.commitIndex
+	rf.goAppendEntries(i, args, rpcStamp{hb, token})
+}
+
+// sendCommit tells the peers that haven't heard of the commit index yet,
+// and have nothing in flight that will, about it. called with rf.mu held.
+func (rf *Raft) sendCommit() {
+	for _, i := range rf.replicationTargets() {
+		if len(rf.inflight[i]) == 0 && rf.sentCommit[i] < rf.commitIndex {
+			rf.sendEmpty(i, rf.currTerm)
+		}
+	}
+}
+
+// sendEmpty sends peer i an AppendEntries without entries. it tells the
+// peer the commit index, and finds out how far its log matches mine if
+// nothing else is on the way. called with rf.mu held.
+func (rf *Raft) sendEmpty(i int, term int32) {
+	hb := hbStamp{round: rf.hbRound, sent: rf.sim.Now()}
+
+	prevInd := rf.nextIndex[i] - 1
+	if len(rf.inflight[i]) > 0 {
+		// entries past matchIndex are on their way; don't make the peer reject them
+		prevInd = rf.matchIndex[i]
+	}
+	if prevInd < rf.lastIncludedIndex {
+		prevInd = rf.lastIncludedIndex
+	}
+
+	args := &AppendEntriesArg{
+		Term:         term,
+		LeaderId:     rf.me,
+		PrevLogIndex: prevInd,
+		PrevLogTerm:  int(rf.logAt(prevInd).Term),
+		Entries:      []LogEntry{},
+		LeaderCommit: int32(rf.commitIndex),
+	}
+	rf.sentCommit[i] = rf.commitIndex
+	rf.goAppendEntries(i, args, rpcStamp{hb, 0})
+}
+
+// peerRPCs are the AppendEntries out to a peer while I lead in a term.
+// they come back on done, which is bounded: the calls wait for room on
+// it, so they can't get ahead of collect() by more than that.
+type peerRPCs struct {
+	done  chan *labrpc.AsyncCall
+	calls map[*labrpc.AsyncCall]rpcStamp // guarded by rf.mu
+}
+
+// rpcStamp is what appendEntriesDone() needs to know about an RPC besides
+// its args and reply.
+type rpcStamp struct {
+	hb    hbStamp
+	token uint64 // the replicator's, 0 for an empty AppendEntries
+}
+
+// goAppendEntries sends peer i args, without waiting for the reply.
+// called with rf.mu held.
+func (rf *Raft) goAppendEntries(i int, args *AppendEntriesArg, stamp rpcStamp) {
+	out := rf.out[i]
+	c := rf.peers[i].GoContext(rf.leading, "Raft.AppendEntries", args, &AppendEntriesReply{}, out.done)
+	out.calls[c] = stamp
+}
+
+// collect handles the replies to the AppendEntries in out, sent to peer
+// i, as they come back; once I stop leading (stop is closed) and they
+// have all come back, it returns.
+func (rf *Raft) collect(i int, out *peerRPCs, stop <-chan struct{}) {
+	for {
+		c, got := labsim.RecvOr(rf.sim, out.done, stop)
+		if !got {
+			// the calls still out give up soon, since they go out with rf.leading
+			rf.mu.Lock()
+			left := len(out.calls)
+			rf.mu.Unlock()
+			if left == 0 {
+				return
+			}
+			c, _ = labsim.Recv(rf.sim, out.done)
+		}
+
+		rf.mu.Lock()
+		stamp := out.calls[c]
+		delete(out.calls, c)
+		rf.appendEntriesDone(c.Args.(*AppendEntriesArg), c.Reply.(*AppendEntriesReply), c.Error == nil, i, stamp.hb, stamp.token)
+		rf.mu.Unlock()
+	}
+}
+
+// sendSnapshot sends peer i the snapshot data from offset from on, in
+// chunks of snapshotChunk bytes that go out as a stream: up to maxInflight
+// of them are on their way at a time, and the next waits for one of those
+// to come back. each is args with a part of data. the stream stops at the
+// first chunk that fails; the peer says how far it got, and the next
+// attempt goes on from there.
+func (rf *Raft) sendSnapshot(ctx context.Context, args InstallSnapshotArgs, data []byte, from int, i int, hb hbStamp, token uint64) {
+	st := rf.peers[i].OpenStream(ctx, "Raft.InstallSnapshot", rf.maxInflight)
+	replies := []*InstallSnapshotReply{}
+	for off := from; off == from || off < len(data); off += rf.snapshotChunk {
+		end := off + rf.snapshotChunk
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := args
+		chunk.Offset = off
+		chunk.Data = data[off:end]
+		reply := &InstallSnapshotReply{}
+		if st.Send(&chunk, reply) != nil {
+			break
+		}
+		replies = append(replies, reply)
+	}
+	st.Close()
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.snapshotDone(&args, replies, i, hb, token)
+}
@@ -9,12 +9,22 @@ package raft
 //
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"lab4/labrpc"
+	"lab4/labsim"
 )
 
 // The tester generously allows solutions to complete elections in one second
@@ -1096,3 +1106,1437 @@ func TestReliableChurn4C(t *testing.T) {
 func TestUnreliableChurn4C(t *testing.T) {
 	internalChurn(t, true)
 }
+
+const MAXLOGSIZE = 2000
+
+func snapcommon(t *testing.T, name string, disconnect bool, reliable bool, crash bool) {
+	iters := 30
+	servers := 3
+	cfg := make_config(t, servers, !reliable, true)
+	defer cfg.cleanup()
+
+	cfg.begin(name)
+
+	cfg.one(rand.Int(), servers, true)
+	leader1 := cfg.checkOneLeader()
+
+	for i := 0; i < iters; i++ {
+		victim := (leader1 + 1) % servers
+		sender := leader1
+		if i%3 == 1 {
+			sender = (leader1 + 1) % servers
+			victim = leader1
+		}
+
+		if disconnect {
+			cfg.disconnect(victim)
+			cfg.one(rand.Int(), servers-1, true)
+		}
+		if crash {
+			cfg.crash1(victim)
+			cfg.one(rand.Int(), servers-1, true)
+		}
+
+		// perhaps send enough to get a snapshot
+		nn := (SnapShotInterval / 2) + (rand.Int() % SnapShotInterval)
+		for i := 0; i < nn; i++ {
+			cfg.rafts[sender].Start(rand.Int())
+		}
+
+		// let applier threads catch up with the Start()'s
+		if disconnect == false && crash == false {
+			// make sure all followers have caught up, so that
+			// an InstallSnapshot RPC isn't required for
+			// TestSnapshotBasic4D().
+			cfg.one(rand.Int(), servers, true)
+		} else {
+			cfg.one(rand.Int(), servers-1, true)
+		}
+
+		if cfg.LogSize() >= MAXLOGSIZE {
+			cfg.t.Fatalf("Log size too large")
+		}
+		if disconnect {
+			// reconnect a follower, who maybe behind and
+			// needs to receive a snapshot to catch up.
+			cfg.connect(victim)
+			cfg.one(rand.Int(), servers, true)
+			leader1 = cfg.checkOneLeader()
+		}
+		if crash {
+			cfg.start1(victim, cfg.applierSnap)
+			cfg.connect(victim)
+			cfg.one(rand.Int(), servers, true)
+			leader1 = cfg.checkOneLeader()
+		}
+	}
+	cfg.end()
+}
+
+func TestSnapshotBasic4D(t *testing.T) {
+	snapcommon(t, "Test (4D): snapshots basic", false, true, false)
+}
+
+func TestSnapshotInstall4D(t *testing.T) {
+	snapcommon(t, "Test (4D): install snapshots (disconnect)", true, true, false)
+}
+
+func TestSnapshotInstallUnreliable4D(t *testing.T) {
+	snapcommon(t, "Test (4D): install snapshots (disconnect+unreliable)",
+		true, false, false)
+}
+
+func TestSnapshotInstallCrash4D(t *testing.T) {
+	snapcommon(t, "Test (4D): install snapshots (crash)", false, true, true)
+}
+
+// do the servers persist the snapshots, and
+// restart using snapshot along with the
+// tail of the log?
+func TestSnapshotAllCrash4D(t *testing.T) {
+	servers := 3
+	iters := 5
+	cfg := make_config(t, servers, false, true)
+	defer cfg.cleanup()
+
+	cfg.begin("Test (4D): crash and restart all servers")
+
+	cfg.one(rand.Int(), servers, true)
+
+	for i := 0; i < iters; i++ {
+		// perhaps enough to get a snapshot
+		nn := (SnapShotInterval / 2) + (rand.Int() % SnapShotInterval)
+		for i := 0; i < nn; i++ {
+			cfg.one(rand.Int(), servers, true)
+		}
+
+		index1 := cfg.one(rand.Int(), servers, true)
+
+		// crash all
+		for i := 0; i < servers; i++ {
+			cfg.crash1(i)
+		}
+
+		// revive all
+		for i := 0; i < servers; i++ {
+			cfg.start1(i, cfg.applierSnap)
+			cfg.connect(i)
+		}
+
+		index2 := cfg.one(rand.Int(), servers, true)
+		if index2 < index1+1 {
+			t.Fatalf("index decreased from %v to %v", index1, index2)
+		}
+	}
+	cfg.end()
+}
+
+func TestMembershipChange(t *testing.T) {
+	servers := 5
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: add and remove servers")
+
+	cfg.one(101, servers, true)
+
+	// shrink the configuration to three servers, one at a time.
+	leader1 := cfg.checkOneLeader()
+	removed := []int{(leader1 + 1) % servers, (leader1 + 2) % servers}
+	for i, s := range removed {
+		leader := cfg.checkOneLeader()
+		index, _, ok := cfg.rafts[leader].RemoveServer(s)
+		if !ok {
+			t.Fatalf("leader %v refused to remove server %v", leader, s)
+		}
+		cfg.wait(index, servers-1-i, -1)
+	}
+	for _, s := range removed {
+		cfg.disconnect(s)
+	}
+
+	// two out of three members are a majority of the new configuration,
+	// though they'd be a minority of the old one.
+	leader2 := cfg.checkOneLeader()
+	other := (leader2 + 3) % servers
+	if other == leader2 || other == removed[0] || other == removed[1] {
+		other = (leader2 + 4) % servers
+	}
+	cfg.disconnect(other)
+	cfg.one(102, 2, true)
+	cfg.connect(other)
+
+	// the leader can remove itself, after which the rest elect a new one.
+	index, _, ok := cfg.rafts[leader2].RemoveServer(leader2)
+	if !ok {
+		t.Fatalf("leader %v refused to remove itself", leader2)
+	}
+	cfg.wait(index, 2, -1)
+	time.Sleep(RaftElectionTimeout)
+	leader3 := cfg.checkOneLeader()
+	if leader3 == leader2 {
+		t.Fatalf("removed server %v is still the leader", leader2)
+	}
+	cfg.one(103, 2, true)
+
+	// a second change can't start before the first one commits.
+	cfg.disconnect((leader3 + 1) % servers)
+	cfg.disconnect((leader3 + 2) % servers)
+	cfg.disconnect((leader3 + 3) % servers)
+	cfg.disconnect((leader3 + 4) % servers)
+	if _, _, ok := cfg.rafts[leader3].AddServer(leader2); !ok {
+		t.Fatalf("leader %v refused to add server %v", leader3, leader2)
+	}
+	if _, _, ok := cfg.rafts[leader3].AddServer(removed[0]); ok {
+		t.Fatalf("leader %v started a second config change before the first committed", leader3)
+	}
+	for i := 0; i < servers; i++ {
+		cfg.connect(i)
+	}
+
+	// grow back to everyone.
+	for _, s := range removed {
+		for iters := 0; ; iters++ {
+			leader := cfg.checkOneLeader()
+			index, _, ok := cfg.rafts[leader].AddServer(s)
+			if ok {
+				cfg.wait(index, 3, -1)
+				break
+			}
+			if iters > 20 {
+				t.Fatalf("couldn't add server %v back", s)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	cfg.one(104, servers, true)
+
+	cfg.end()
+}
+
+func TestPreVote(t *testing.T) {
+	servers := 3
+	cfg := make_config_opts(t, servers, false, false, Options{PreVote: true})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: pre-vote keeps a partitioned server from disrupting")
+
+	cfg.one(101, servers, true)
+	leader1 := cfg.checkOneLeader()
+	term1 := cfg.checkTerms()
+
+	// a follower that can't reach anyone shouldn't keep bumping its term.
+	follower := (leader1 + 1) % servers
+	cfg.disconnect(follower)
+	time.Sleep(3 * RaftElectionTimeout)
+	if term, _ := cfg.rafts[follower].GetState(); term != term1 {
+		t.Fatalf("partitioned server moved from term %v to %v", term1, term)
+	}
+	cfg.one(102, servers-1, true)
+
+	// and when it comes back, the leader should stay the leader.
+	cfg.connect(follower)
+	cfg.one(103, servers, true)
+	leader2 := cfg.checkOneLeader()
+	if leader2 != leader1 {
+		t.Fatalf("leader changed from %v to %v after a follower rejoined", leader1, leader2)
+	}
+	if term2 := cfg.checkTerms(); term2 != term1 {
+		t.Fatalf("term changed from %v to %v after a follower rejoined", term1, term2)
+	}
+
+	// pre-vote mustn't get in the way of electing a new leader.
+	cfg.disconnect(leader1)
+	cfg.one(104, servers-1, true)
+	cfg.connect(leader1)
+	cfg.one(105, servers, true)
+
+	cfg.end()
+}
+
+func TestReadIndex(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: linearizable reads with ReadIndex")
+
+	leader1 := cfg.checkOneLeader()
+
+	// nothing has been committed in the leader's term yet.
+	if _, err := cfg.rafts[leader1].ReadIndex(context.Background()); err != ErrNoCommitInTerm {
+		t.Fatalf("expected ErrNoCommitInTerm from a fresh leader, got %v", err)
+	}
+
+	index1 := cfg.one(101, servers, true)
+	leader1 = cfg.checkOneLeader()
+
+	// followers can't serve reads.
+	follower := (leader1 + 1) % servers
+	if _, err := cfg.rafts[follower].ReadIndex(context.Background()); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader from a follower, got %v", err)
+	}
+
+	// reads see every committed write, and don't add to the log.
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), RaftElectionTimeout)
+		index, err := cfg.rafts[leader1].ReadIndex(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("ReadIndex failed: %v", err)
+		}
+		if index < index1 {
+			t.Fatalf("read index %v is behind committed index %v", index, index1)
+		}
+	}
+	if index2 := cfg.one(102, servers, true); index2 != index1+1 {
+		t.Fatalf("reads grew the log: expected next index %v, got %v", index1+1, index2)
+	}
+
+	// a leader that can't reach a majority can't confirm it's still the leader.
+	cfg.disconnect(leader1)
+	ctx, cancel := context.WithTimeout(context.Background(), RaftElectionTimeout)
+	_, err := cfg.rafts[leader1].ReadIndex(ctx)
+	cancel()
+	if err == nil {
+		t.Fatalf("partitioned leader %v served a read", leader1)
+	}
+
+	// the new leader can serve reads once it commits something.
+	cfg.one(103, servers-1, true)
+	leader2 := cfg.checkOneLeader()
+	ctx, cancel = context.WithTimeout(context.Background(), RaftElectionTimeout)
+	_, err = cfg.rafts[leader2].ReadIndex(ctx)
+	cancel()
+	if err != nil {
+		t.Fatalf("new leader %v failed to serve a read: %v", leader2, err)
+	}
+	cfg.connect(leader1)
+
+	cfg.end()
+}
+
+func TestLeaseRead(t *testing.T) {
+	servers := 3
+	cfg := make_config_opts(t, servers, false, false,
+		Options{LeaseRead: true, ClockDrift: 50 * time.Millisecond})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: leader leases")
+
+	index1 := cfg.one(101, servers, true)
+	leader1 := cfg.checkOneLeader()
+
+	// a few rounds of HBs later, the leader holds a lease.
+	time.Sleep(300 * time.Millisecond)
+	index, ok := cfg.rafts[leader1].LeaseRead()
+	if !ok {
+		t.Fatalf("leader %v has no lease", leader1)
+	}
+	if index < index1 {
+		t.Fatalf("lease read index %v is behind committed index %v", index, index1)
+	}
+	if _, ok := cfg.rafts[(leader1+1)%servers].LeaseRead(); ok {
+		t.Fatalf("follower claims to hold a lease")
+	}
+
+	// a partitioned leader's lease runs out before anyone else can be elected.
+	cfg.disconnect(leader1)
+	t0 := time.Now()
+	for time.Since(t0) < 2*RaftElectionTimeout {
+		_, ok := cfg.rafts[leader1].LeaseRead()
+		for i := 0; i < servers; i++ {
+			if i == leader1 {
+				continue
+			}
+			if _, isLeader := cfg.rafts[i].GetState(); isLeader && ok {
+				t.Fatalf("old leader %v still holds a lease while %v is the leader", leader1, i)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := cfg.rafts[leader1].LeaseRead(); ok {
+		t.Fatalf("partitioned leader %v still holds a lease", leader1)
+	}
+
+	cfg.one(102, servers-1, true)
+	leader2 := cfg.checkOneLeader()
+	time.Sleep(300 * time.Millisecond)
+	if _, ok := cfg.rafts[leader2].LeaseRead(); !ok {
+		t.Fatalf("new leader %v has no lease", leader2)
+	}
+	cfg.connect(leader1)
+	cfg.one(103, servers, true)
+
+	cfg.end()
+}
+
+func TestLeaseReadDisabled(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: no leases unless enabled")
+
+	cfg.one(101, servers, true)
+	leader := cfg.checkOneLeader()
+	time.Sleep(300 * time.Millisecond)
+	if _, ok := cfg.rafts[leader].LeaseRead(); ok {
+		t.Fatalf("leader %v holds a lease without Options.LeaseRead", leader)
+	}
+
+	cfg.end()
+}
+
+func TestTransferLeadership(t *testing.T) {
+	servers := 3
+	cfg := make_config_opts(t, servers, false, false, Options{PreVote: true})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: leadership transfer")
+
+	cfg.one(101, servers, true)
+	leader1 := cfg.checkOneLeader()
+
+	if err := cfg.rafts[(leader1+1)%servers].TransferLeadership(leader1); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader from a follower, got %v", err)
+	}
+	if err := cfg.rafts[leader1].TransferLeadership(leader1); err != ErrBadTransferTarget {
+		t.Fatalf("expected ErrBadTransferTarget when transferring to itself, got %v", err)
+	}
+
+	// hand leadership to a follower; it should take over well within an
+	// election timeout.
+	target := (leader1 + 1) % servers
+	t0 := time.Now()
+	if err := cfg.rafts[leader1].TransferLeadership(target); err != nil {
+		t.Fatalf("transfer from %v to %v failed: %v", leader1, target, err)
+	}
+	for {
+		if _, isLeader := cfg.rafts[target].GetState(); isLeader {
+			break
+		}
+		if time.Since(t0) > RaftElectionTimeout/2 {
+			t.Fatalf("%v didn't take over quickly", target)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if leader2 := cfg.checkOneLeader(); leader2 != target {
+		t.Fatalf("expected %v to be the leader, got %v", target, leader2)
+	}
+	cfg.one(102, servers, true)
+
+	// a follower that is behind has to catch up before it can take over.
+	// (pre-vote keeps it from bumping its term while it's disconnected, which
+	// would depose the leader as soon as it's back.)
+	leader2 := target
+	target = (leader2 + 1) % servers
+	cfg.disconnect(target)
+	for i := 0; i < 10; i++ {
+		cfg.one(200+i, servers-1, true)
+	}
+	cfg.connect(target)
+	if err := cfg.rafts[leader2].TransferLeadership(target); err != nil {
+		t.Fatalf("transfer from %v to lagging %v failed: %v", leader2, target, err)
+	}
+	if leader3 := cfg.checkOneLeader(); leader3 != target {
+		t.Fatalf("expected %v to be the leader, got %v", target, leader3)
+	}
+	cfg.one(103, servers, true)
+
+	cfg.end()
+}
+
+// a new leader doesn't change the configuration before it has committed an
+// entry of its term; until then, an earlier leader's change it doesn't know
+// of could still commit, and the two could make for two majorities.
+func TestConfigChangeNewLeader(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: no config change before committing in the term")
+
+	cfg.one(101, servers, true)
+	leader1 := cfg.checkOneLeader()
+	cfg.disconnect(leader1)
+
+	leader2 := cfg.checkOneLeader()
+	if _, _, ok := cfg.rafts[leader2].RemoveServer(leader1); ok {
+		t.Fatalf("new leader %v changed the configuration before committing in its term", leader2)
+	}
+	cfg.one(102, servers-1, true)
+	leader2 = cfg.checkOneLeader()
+	index, _, ok := cfg.rafts[leader2].RemoveServer(leader1)
+	if !ok {
+		t.Fatalf("leader %v refused to remove server %v", leader2, leader1)
+	}
+	cfg.wait(index, servers-1, -1)
+
+	cfg.end()
+}
+
+func TestLearners(t *testing.T) {
+	servers := 5
+	cfg := make_config_opts(t, servers, false, false, Options{Members: []int{0, 1, 2}})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: learners")
+
+	cfg.one(101, 3, true)
+
+	// servers 3 and 4 join as learners and catch up.
+	for s := 3; s < servers; s++ {
+		leader := cfg.checkOneLeader()
+		index, _, ok := cfg.rafts[leader].AddLearner(s)
+		if !ok {
+			t.Fatalf("leader %v refused to add learner %v", leader, s)
+		}
+		cfg.wait(index, s+1, -1)
+	}
+	cfg.one(102, servers, true)
+	for s := 3; s < servers; s++ {
+		cfg.rafts[s].mu.Lock()
+		state := cfg.rafts[s].raftState
+		cfg.rafts[s].mu.Unlock()
+		if state != Learner {
+			t.Fatalf("server %v is in state %v, not a learner", s, state)
+		}
+	}
+
+	// the leader and the two learners are a majority of all servers,
+	// but only one of three voters, so nothing can commit.
+	leader := cfg.checkOneLeader()
+	for i := 0; i < 3; i++ {
+		if i != leader {
+			cfg.disconnect(i)
+		}
+	}
+	index, _, ok := cfg.rafts[leader].Start(103)
+	if !ok {
+		t.Fatalf("leader %v lost leadership", leader)
+	}
+	time.Sleep(RaftElectionTimeout)
+	if n, _ := cfg.nCommitted(index); n > 0 {
+		t.Fatalf("%v committed with learners counted towards the majority", n)
+	}
+
+	// learners never become leader.
+	cfg.disconnect(leader)
+	time.Sleep(2 * RaftElectionTimeout)
+	cfg.checkNoLeader()
+	for i := 0; i < 3; i++ {
+		cfg.connect(i)
+	}
+	cfg.one(104, servers, true)
+
+	// a caught-up learner can be promoted to a voter.
+	leader = cfg.checkOneLeader()
+	if _, _, ok := cfg.rafts[leader].PromoteLearner((leader + 1) % 3); ok {
+		t.Fatalf("leader %v promoted a voter", leader)
+	}
+	index, _, ok = cfg.rafts[leader].PromoteLearner(3)
+	if !ok {
+		t.Fatalf("leader %v refused to promote learner 3", leader)
+	}
+	cfg.wait(index, servers, -1)
+
+	// with voters 0-3, losing the leader still leaves a majority, which
+	// needs server 3's vote.
+	cfg.disconnect(leader)
+	cfg.one(105, servers-1, true)
+	if leader2 := cfg.checkOneLeader(); leader2 == 4 {
+		t.Fatalf("learner 4 became leader")
+	}
+	cfg.connect(leader)
+	cfg.one(106, servers, true)
+
+	cfg.end()
+}
+
+func TestPipelinedReplication(t *testing.T) {
+	servers := 3
+	cfg := make_config_opts(t, servers, false, false, Options{MaxEntriesPerAppend: 16, MaxInflightAppends: 2})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: pipelined and batched replication")
+
+	cfg.one(rand.Int(), servers, true)
+
+	// entries go out as soon as they're started, not with the next HB, and
+	// so does the commit index once a majority has them; so a majority
+	// applies them well before the next HB.
+	iters := 20
+	t0 := time.Now()
+	for i := 0; i < iters; i++ {
+		cfg.one(rand.Int(), servers/2+1, false)
+	}
+	if d := time.Since(t0) / time.Duration(iters); d > 60*time.Millisecond {
+		t.Fatalf("took %v on average to commit an entry; expected well under one HB", d)
+	}
+
+	// a burst much larger than one AppendEntries is committed in batches.
+	leader := cfg.checkOneLeader()
+	var last int
+	for i := 0; i < 200; i++ {
+		index, _, ok := cfg.rafts[leader].Start(rand.Int())
+		if !ok {
+			t.Fatalf("leader %v lost leadership", leader)
+		}
+		last = index
+	}
+	cfg.wait(last, servers, -1)
+
+	// a follower that was away catches up through the pipeline.
+	follower := (leader + 1) % servers
+	cfg.disconnect(follower)
+	for i := 0; i < 100; i++ {
+		cfg.rafts[leader].Start(rand.Int())
+	}
+	cfg.connect(follower)
+	cfg.one(rand.Int(), servers, true)
+
+	cfg.end()
+}
+
+func TestGroupCommit(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: group commit and StartBatch")
+
+	cfg.one(rand.Int(), servers, true)
+	leader := cfg.checkOneLeader()
+
+	// a batch gets consecutive indexes.
+	cmds := make([]interface{}, 50)
+	for i := range cmds {
+		cmds[i] = rand.Int()
+	}
+	first, last, _, ok := cfg.rafts[leader].StartBatch(cmds)
+	if !ok {
+		t.Fatalf("leader %v rejected StartBatch", leader)
+	}
+	if last-first+1 != len(cmds) {
+		t.Fatalf("StartBatch of %v commands returned indexes %v to %v", len(cmds), first, last)
+	}
+	for i, cmd := range cmds {
+		if got := cfg.wait(first+i, servers, -1); got != cmd {
+			t.Fatalf("index %v has %v; expected %v", first+i, got, cmd)
+		}
+	}
+
+	// many clients calling Start() at once.
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	maxIndex := 0
+	for c := 0; c < 20; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				index, _, ok := cfg.rafts[leader].Start(rand.Int())
+				if !ok {
+					return
+				}
+				mu.Lock()
+				if index > maxIndex {
+					maxIndex = index
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	cfg.wait(maxIndex, servers, -1)
+
+	// everything committed was persisted.
+	for i := 0; i < servers; i++ {
+		cfg.crash1(i)
+	}
+	for i := 0; i < servers; i++ {
+		cfg.start1(i, cfg.applier)
+		cfg.connect(i)
+	}
+	if index := cfg.one(rand.Int(), servers, true); index <= maxIndex {
+		t.Fatalf("the restarted servers lost committed entries; next index is %v", index)
+	}
+
+	cfg.end()
+}
+
+func TestPersistTruncatedLog(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: persist a log that was truncated")
+
+	cfg.one(rand.Int(), servers, true)
+
+	// enough entries that they're persisted in several pieces.
+	for i := 0; i < 50; i++ {
+		cfg.one(rand.Int(), servers, true)
+	}
+
+	// the leader persists entries that never commit...
+	leader1 := cfg.checkOneLeader()
+	cfg.disconnect(leader1)
+	for i := 0; i < 5; i++ {
+		cfg.rafts[leader1].Start(rand.Int())
+	}
+
+	// ...and the others commit different ones in their place.
+	for i := 0; i < 5; i++ {
+		cfg.one(rand.Int(), servers-1, true)
+	}
+
+	// the old leader restarts with the stale entries, and replaces them.
+	cfg.crash1(leader1)
+	cfg.start1(leader1, cfg.applier)
+	cfg.connect(leader1)
+	cfg.one(rand.Int(), servers, true)
+
+	// everyone restarts with the replacements.
+	for i := 0; i < servers; i++ {
+		cfg.crash1(i)
+	}
+	for i := 0; i < servers; i++ {
+		cfg.start1(i, cfg.applier)
+		cfg.connect(i)
+	}
+	cfg.one(rand.Int(), servers, true)
+
+	cfg.end()
+}
+
+func TestFilePersister(t *testing.T) {
+	dir := t.TempDir()
+
+	ps, err := OpenFilePersister(dir)
+	if err != nil {
+		t.Fatalf("OpenPersister: %v", err)
+	}
+	ps.Save([]byte("state"), []byte("snapshot"))
+	ps.AppendState([]byte("+one"))
+	ps.AppendState([]byte("+two"))
+	ps.Close()
+
+	check := func(state string, snapshot string) {
+		ps, err := OpenFilePersister(dir)
+		if err != nil {
+			t.Fatalf("OpenPersister: %v", err)
+		}
+		defer ps.Close()
+		if got := string(ps.ReadRaftState()); got != state {
+			t.Fatalf("read state %q; expected %q", got, state)
+		}
+		if got := string(ps.ReadSnapshot()); got != snapshot {
+			t.Fatalf("read snapshot %q; expected %q", got, snapshot)
+		}
+	}
+	check("state+one+two", "snapshot")
+
+	// a write torn by a crash is dropped, and doesn't get in the way of the next.
+	ps, _ = OpenFilePersister(dir)
+	f, err := os.OpenFile(ps.walPath(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open WAL: %v", err)
+	}
+	f.Write([]byte{10, '+', 't', 'h'})
+	f.Close()
+	ps.Close()
+	check("state+one+two", "snapshot")
+
+	ps, _ = OpenFilePersister(dir)
+	ps.AppendState([]byte("+three"))
+	ps.Close()
+	check("state+one+two+three", "snapshot")
+
+	// Save() starts over, and leaves nothing behind.
+	ps, _ = OpenFilePersister(dir)
+	ps.Save([]byte("new"), nil)
+	ps.AppendState([]byte("+four"))
+	ps.Close()
+	check("new+four", "")
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Fatalf("expected the state and one WAL in %v, found %v files", dir, len(entries))
+	}
+
+	// a flipped byte before the end of the WAL isn't a torn write; the
+	// pieces after it mustn't be dropped, so it won't open.
+	ps, _ = OpenFilePersister(dir)
+	ps.AppendState([]byte("+five"))
+	ps.AppendState([]byte("+six"))
+	path := ps.walPath()
+	ps.Close()
+	wal, _ := os.ReadFile(path)
+	for _, off := range []int{0, 2} { // the length, the data of "+four"
+		bad := append([]byte{}, wal...)
+		bad[off] ^= 0x40
+		os.WriteFile(path, bad, 0o644)
+		if _, err := OpenFilePersister(dir); !errors.Is(err, ErrCorruptState) {
+			t.Fatalf("WAL with byte %v flipped: error %v isn't ErrCorruptState", off, err)
+		}
+		if got, _ := os.ReadFile(path); !bytes.Equal(got, bad) {
+			t.Fatalf("the corrupt WAL was changed")
+		}
+	}
+	os.WriteFile(path, wal, 0o644)
+	check("new+four+five+six", "")
+
+	// but a last piece that fails its checksum was torn, and is dropped.
+	bad := append([]byte{}, wal...)
+	bad[len(bad)-6] ^= 0x40 // in "+six"
+	os.WriteFile(path, bad, 0o644)
+	check("new+four+five", "")
+	os.WriteFile(path, wal, 0o644)
+
+	// a corrupt "state" says where.
+	state, _ := os.ReadFile(filepath.Join(dir, stateFile))
+	state[10] ^= 0x40
+	os.WriteFile(filepath.Join(dir, stateFile), state, 0o644)
+	var cse *CorruptStateError
+	if _, err := OpenFilePersister(dir); !errors.As(err, &cse) || !strings.HasPrefix(cse.Reason, stateFile) {
+		t.Fatalf("corrupt state: error %v isn't a *CorruptStateError for %q", err, stateFile)
+	}
+}
+
+func TestFilePersisterRestart(t *testing.T) {
+	dir := t.TempDir()
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+
+	// a configuration of one, whose log has to survive restarts.
+	start := func(name string) (*Raft, *FilePersister, chan ApplyMsg) {
+		ps, err := OpenFilePersister(dir)
+		if err != nil {
+			t.Fatalf("OpenPersister: %v", err)
+		}
+		applyCh := make(chan ApplyMsg, 100)
+		return Make([]*labrpc.ClientEnd{net.MakeEnd(name)}, 0, ps, applyCh), ps, applyCh
+	}
+	waitLeader := func(rf *Raft) {
+		for iters := 0; iters < 50; iters++ {
+			if _, isLeader := rf.GetState(); isLeader {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("no leader")
+	}
+	applied := func(applyCh chan ApplyMsg, n int) []interface{} {
+		cmds := []interface{}{}
+		for len(cmds) < n {
+			select {
+			case m := <-applyCh:
+				if m.CommandValid {
+					cmds = append(cmds, m.Command)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("applied only %v of %v commands", len(cmds), n)
+			}
+		}
+		return cmds
+	}
+
+	fmt.Printf("Test: file-backed Persister survives restarts ...\n")
+
+	rf, ps, applyCh := start("first")
+	waitLeader(rf)
+	for i := 0; i < 20; i++ {
+		rf.Start(100 + i)
+	}
+	applied(applyCh, 20)
+	rf.Kill()
+	ps.Close()
+
+	rf, ps, applyCh = start("second")
+	defer ps.Close()
+	defer rf.Kill()
+	waitLeader(rf)
+	rf.Start(200)
+	cmds := applied(applyCh, 21)
+	for i := 0; i < 20; i++ {
+		if cmds[i] != 100+i {
+			t.Fatalf("command %v is %v after the restart; expected %v", i+1, cmds[i], 100+i)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestCorruptState(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: refuse to start from a corrupt state")
+
+	for i := 0; i < 10; i++ {
+		cfg.one(rand.Int(), servers, true)
+	}
+	cfg.crash1(0)
+	state := cfg.saved[0].ReadRaftState()
+
+	corrupt := map[string][]byte{
+		"garbage":        []byte("not a raft state"),
+		"unknown format": append(append([]byte{}, stateMagic...), stateVersion+1),
+		"flipped byte":   append([]byte{}, state...),
+	}
+	corrupt["flipped byte"][len(stateMagic)+3] ^= 0xff
+	// a record in the middle whose length runs past the end, with a newer
+	// hard state after it that mustn't be silently dropped.
+	mid := appendRecord(nil, stateRecord{Kind: recordHardState, Term: 7, VotedFor: 2})
+	mid[1] = 0x7f
+	corrupt["bad length"] = append(append(append([]byte{}, state...), mid...),
+		appendRecord(nil, stateRecord{Kind: recordHardState, Term: 8, VotedFor: 2})...)
+	for what, data := range corrupt {
+		ps := MakePersister()
+		ps.SaveState(data)
+		ends := make([]*labrpc.ClientEnd, servers)
+		for j := range ends {
+			ends[j] = cfg.net.MakeEnd(randstring(20))
+		}
+		rf, err := MakeWithOptions(ends, 0, ps, make(chan ApplyMsg), Options{})
+		if err == nil {
+			rf.Kill()
+			t.Fatalf("started from a state with %v", what)
+		}
+		if !errors.Is(err, ErrCorruptState) {
+			t.Fatalf("state with %v: error %v isn't ErrCorruptState", what, err)
+		}
+	}
+
+	// a record torn by a crash at the very end is dropped.
+	torn := appendRecord(nil, stateRecord{Kind: recordHardState, Term: 1000, VotedFor: 1})
+	cfg.saved[0].SaveState(append(state, torn[:len(torn)-2]...))
+	cfg.start1(0, cfg.applier)
+	cfg.connect(0)
+	if term, _ := cfg.rafts[0].GetState(); term >= 1000 {
+		t.Fatalf("restarted with the term of a torn record")
+	}
+	cfg.one(rand.Int(), servers, true)
+
+	cfg.end()
+}
+
+func TestFaultyPersister(t *testing.T) {
+	// a crash while AppendState("+more") is in progress, with each outcome.
+	crash := func(faults Faults) string {
+		faults.MinDelay = 200 * time.Millisecond
+		faults.MaxDelay = faults.MinDelay
+		ps := MakeFaultyPersister(faults)
+		ps.Save([]byte("state"), []byte("snapshot"))
+		go ps.AppendState([]byte("+more"))
+		time.Sleep(50 * time.Millisecond)
+		np := ps.Copy()
+		if got := string(np.ReadSnapshot()); got != "snapshot" {
+			t.Fatalf("snapshot %q after a crash; expected %q", got, "snapshot")
+		}
+		return string(np.ReadRaftState())
+	}
+
+	if got := crash(Faults{Seed: 1, LoseRate: 1}); got != "state" {
+		t.Fatalf("lost write left %q; expected %q", got, "state")
+	}
+	if got := crash(Faults{Seed: 1}); got != "state+more" {
+		t.Fatalf("finished write left %q; expected %q", got, "state+more")
+	}
+	for seed := int64(0); seed < 10; seed++ {
+		got := crash(Faults{Seed: seed, TearRate: 1})
+		if len(got) < len("state") || len(got) >= len("state+more") || got != "state+more"[:len(got)] {
+			t.Fatalf("torn write left %q; expected a prefix of %q", got, "state+more")
+		}
+	}
+
+	// the crashed Persister drops its writes, but doesn't block them.
+	ps := MakeFaultyPersister(Faults{Seed: 1})
+	ps.Save([]byte("early"), nil)
+	ps.Copy()
+	done := make(chan bool)
+	go func() {
+		ps.Save([]byte("late"), nil)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("a write to a crashed Persister blocked")
+	}
+	if got := string(ps.ReadRaftState()); got != "early" || !ps.Failed() {
+		t.Fatalf("a crashed Persister holds %q, Failed() %v; expected %q, true", got, ps.Failed(), "early")
+	}
+}
+
+func TestPersisterFaultsChurn(t *testing.T) {
+	servers := 5
+	faults := &Faults{
+		Seed:     makeSeed(),
+		MaxDelay: 5 * time.Millisecond,
+		TearRate: 0.3,
+		LoseRate: 0.3,
+	}
+	cfg := make_config_faults(t, servers, false, false, Options{}, faults)
+	defer cfg.cleanup()
+
+	cfg.begin(fmt.Sprintf("Test: no committed entry lost to faulty writes (seed %v)", faults.Seed))
+
+	cfg.one(rand.Int(), 1, true)
+
+	nup := servers
+	for iters := 0; iters < 300; iters++ {
+		leader := -1
+		for i := 0; i < servers; i++ {
+			if cfg.rafts[i] != nil {
+				_, _, ok := cfg.rafts[i].Start(rand.Int())
+				if ok {
+					leader = i
+				}
+			}
+		}
+
+		if (rand.Int() % 1000) < 100 {
+			ms := rand.Int63() % (int64(RaftElectionTimeout/time.Millisecond) / 2)
+			time.Sleep(time.Duration(ms) * time.Millisecond)
+		} else {
+			ms := (rand.Int63() % 13)
+			time.Sleep(time.Duration(ms) * time.Millisecond)
+		}
+
+		// crash the leader, or anyone, in the middle of their writes.
+		if leader != -1 && rand.Int()%2 == 0 {
+			cfg.crash1(leader)
+			nup -= 1
+		} else if i := rand.Int() % servers; cfg.rafts[i] != nil && rand.Int()%10 == 0 {
+			cfg.crash1(i)
+			nup -= 1
+		}
+
+		if nup < 3 {
+			s := rand.Int() % servers
+			if cfg.rafts[s] == nil {
+				cfg.start1(s, cfg.applier)
+				cfg.connect(s)
+				nup += 1
+			}
+		}
+	}
+
+	for i := 0; i < servers; i++ {
+		if cfg.rafts[i] == nil {
+			cfg.start1(i, cfg.applier)
+			cfg.connect(i)
+		}
+	}
+
+	cfg.one(rand.Int(), servers, true)
+
+	cfg.end()
+}
+
+func TestTCPTransport(t *testing.T) {
+	servers := 3
+
+	// each peer listens on its own port, as it would in its own process.
+	listeners := make([]net.Listener, servers)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		defer l.Close()
+		listeners[i] = l
+	}
+	rafts := make([]*Raft, servers)
+	applyChs := make([]chan ApplyMsg, servers)
+	for i := range rafts {
+		peers := make([]*labrpc.ClientEnd, servers)
+		for j := range peers {
+			peers[j] = labrpc.MakeTCPEnd("tcp", listeners[j].Addr().String(), labrpc.TCPOptions{})
+			defer peers[j].Close()
+		}
+		applyChs[i] = make(chan ApplyMsg, 100)
+		rafts[i] = Make(peers, i, MakePersister(), applyChs[i])
+		defer rafts[i].Kill()
+
+		srv := labrpc.MakeServer()
+		srv.AddService(labrpc.MakeService(rafts[i]))
+		go srv.Serve(listeners[i])
+	}
+
+	fmt.Printf("Test: agreement over TCP ...\n")
+
+	leader := -1
+	for iters := 0; iters < 50 && leader < 0; iters++ {
+		time.Sleep(100 * time.Millisecond)
+		for i, rf := range rafts {
+			if _, isLeader := rf.GetState(); isLeader {
+				leader = i
+			}
+		}
+	}
+	if leader < 0 {
+		t.Fatalf("no leader")
+	}
+
+	index, _, _ := rafts[leader].Start(100)
+	for i := range rafts {
+		select {
+		case m := <-applyChs[i]:
+			if !m.CommandValid || m.CommandIndex != index || m.Command != 100 {
+				t.Fatalf("server %v applied %+v; expected 100 at %v", i, m, index)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("server %v didn't apply the command", i)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPartitionBridge(t *testing.T) {
+	servers := 5
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: split brain with a bridge server")
+
+	cfg.one(rand.Int(), servers, true)
+	leader1 := cfg.checkOneLeader()
+	others := []int{}
+	for i := 0; i < servers; i++ {
+		if i != leader1 {
+			others = append(others, i)
+		}
+	}
+
+	// the leader only reaches others[0], which reaches everyone.
+	cfg.partition([]int{leader1, others[0]}, others)
+	cfg.rafts[leader1].Start(rand.Int())
+
+	// the side with the majority goes on without the old leader...
+	cfg.one(rand.Int(), servers-1, true)
+	leader2 := cfg.checkOneLeader()
+	if leader2 == leader1 {
+		t.Fatalf("leader %v kept leading with only a bridge to the others", leader1)
+	}
+
+	// ...and the old leader catches up once the network heals.
+	cfg.heal()
+	cfg.one(rand.Int(), servers, true)
+
+	cfg.end()
+}
+
+func TestOneWayLink(t *testing.T) {
+	servers := 3
+	cfg := make_config_opts(t, servers, false, false, Options{PreVote: true})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a one-way link doesn't disrupt the leader")
+
+	cfg.one(rand.Int(), servers, true)
+	leader := cfg.checkOneLeader()
+	term, _ := cfg.rafts[leader].GetState()
+
+	// the follower doesn't hear from the leader, but the leader hears it.
+	follower := (leader + 1) % servers
+	cfg.cutLink(leader, follower)
+	for iters := 0; iters < 10; iters++ {
+		cfg.one(rand.Int(), servers-1, true)
+		time.Sleep(RaftElectionTimeout / 5)
+	}
+	if term2, isLeader := cfg.rafts[leader].GetState(); !isLeader || term2 != term {
+		t.Fatalf("leader %v of term %v was disrupted (term %v, leader %v)", leader, term, term2, isLeader)
+	}
+
+	cfg.heal()
+	cfg.one(rand.Int(), servers, true)
+
+	cfg.end()
+}
+
+func TestWAN(t *testing.T) {
+	servers := 5
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	// three datacenters, far apart.
+	dc := []int{0, 0, 1, 1, 2}
+	local := labrpc.LinkPolicy{Latency: time.Millisecond, Bandwidth: 100 << 20}
+	remote := labrpc.LinkPolicy{
+		Latency:   30 * time.Millisecond,
+		Jitter:    10 * time.Millisecond,
+		Dist:      labrpc.JitterExponential,
+		DropRate:  0.01,
+		Bandwidth: 1 << 20,
+	}
+	for i := 0; i < servers; i++ {
+		for j := 0; j < servers; j++ {
+			if dc[i] == dc[j] {
+				cfg.net.SetLinkPolicy(i, j, local)
+			} else {
+				cfg.net.SetLinkPolicy(i, j, remote)
+			}
+		}
+	}
+
+	cfg.begin("Test: agreement across datacenters")
+
+	cfg.one(rand.Int(), servers, true)
+
+	t0 := time.Now()
+	iters := 20
+	for i := 0; i < iters; i++ {
+		cfg.one(rand.Int(), servers, true)
+	}
+	fmt.Printf("  ... %v per agreement\n", time.Since(t0)/time.Duration(iters))
+
+	// a datacenter goes away.
+	cfg.disconnect(2)
+	cfg.disconnect(3)
+	cfg.one(rand.Int(), servers-2, true)
+	cfg.connect(2)
+	cfg.connect(3)
+	cfg.one(rand.Int(), servers, true)
+
+	cfg.end()
+}
+
+func TestDuplicateRPCs(t *testing.T) {
+	servers := 5
+	cfg := make_config(t, servers, false, false)
+	defer cfg.cleanup()
+
+	// every RPC handler sees copies of requests, some of them late, and
+	// callers sometimes get the reply to a late copy.
+	cfg.net.Duplicate(0.3)
+	cfg.net.StaleReplies(0.3)
+
+	cfg.begin("Test: duplicated RPCs and stale replies")
+
+	cfg.one(rand.Int(), servers, true)
+
+	for iters := 0; iters < 10; iters++ {
+		leader := cfg.checkOneLeader()
+		for i := 0; i < 5; i++ {
+			cfg.rafts[leader].Start(rand.Int())
+		}
+
+		// the leader falls behind, and gets stale copies of what it missed.
+		victim := leader
+		if iters%2 == 1 {
+			victim = (leader + 1) % servers
+		}
+		cfg.disconnect(victim)
+		for i := 0; i < 3; i++ {
+			cfg.one(rand.Int(), servers-1, true)
+		}
+		cfg.connect(victim)
+		cfg.one(rand.Int(), servers, true)
+	}
+
+	cfg.end()
+}
+
+func TestDuplicateSnapshotRPCs(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false, true)
+	defer cfg.cleanup()
+
+	cfg.net.Duplicate(0.3)
+	cfg.net.StaleReplies(0.3)
+
+	cfg.begin("Test: duplicated InstallSnapshot RPCs")
+
+	cfg.one(rand.Int(), servers, true)
+
+	for iters := 0; iters < 10; iters++ {
+		leader := cfg.checkOneLeader()
+		victim := (leader + 1) % servers
+		cfg.disconnect(victim)
+
+		// enough for a snapshot, which the victim has to install.
+		for i := 0; i < SnapShotInterval+rand.Int()%SnapShotInterval; i++ {
+			cfg.rafts[leader].Start(rand.Int())
+		}
+		cfg.one(rand.Int(), servers-1, true)
+
+		cfg.connect(victim)
+		cfg.one(rand.Int(), servers, true)
+		if cfg.LogSize() >= MAXLOGSIZE {
+			cfg.t.Fatalf("Log size too large")
+		}
+	}
+
+	cfg.end()
+}
+
+func TestSnapshotChunks(t *testing.T) {
+	servers := 3
+	cfg := make_config_opts(t, servers, true, true, Options{SnapshotChunkSize: 8})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: snapshots sent in chunks")
+
+	cfg.one(rand.Int(), servers, true)
+
+	for iters := 0; iters < 5; iters++ {
+		leader := cfg.checkOneLeader()
+		victim := (leader + 1) % servers
+		cfg.disconnect(victim)
+
+		// enough for a snapshot, which the victim has to install.
+		for i := 0; i < SnapShotInterval+rand.Int()%SnapShotInterval; i++ {
+			cfg.rafts[leader].Start(rand.Int())
+		}
+		cfg.one(rand.Int(), servers-1, true)
+
+		cfg.net.ResetStats()
+		cfg.connect(victim)
+		cfg.one(rand.Int(), servers, true)
+
+		// the snapshot is many times the chunk size
+		if n := cfg.net.Stats().Methods["Raft.InstallSnapshot"].Calls; n < 2 {
+			t.Fatalf("snapshot sent in %v InstallSnapshot RPCs; expected chunks", n)
+		}
+	}
+
+	cfg.end()
+}
+
+// simFigure8 is TestFigure8Unreliable4C with crashes and snapshots, run in
+// the simulation s. it returns what the servers ended up with.
+func simFigure8(t *testing.T, s *labsim.Sim, iters int) string {
+	servers := 5
+	cfg := make_config_opts(t, servers, true, true, Options{Sim: s})
+	defer cfg.cleanup()
+
+	cfg.one(s.Int()%10000, 1, true)
+
+	nup := servers
+	for iter := 0; iter < iters; iter++ {
+		if iter == iters/5 {
+			cfg.setlongreordering(true)
+		}
+		leader := -1
+		for i := 0; i < servers; i++ {
+			if cfg.rafts[i] == nil {
+				continue
+			}
+			_, _, ok := cfg.rafts[i].Start(s.Int() % 10000)
+			if ok && cfg.connected[i] {
+				leader = i
+			}
+		}
+
+		if (s.Int() % 1000) < 100 {
+			ms := s.Int63() % (int64(RaftElectionTimeout/time.Millisecond) / 2)
+			s.Sleep(time.Duration(ms) * time.Millisecond)
+		} else {
+			ms := (s.Int63() % 13)
+			s.Sleep(time.Duration(ms) * time.Millisecond)
+		}
+
+		if leader != -1 && (s.Int()%1000) < int(RaftElectionTimeout/time.Millisecond)/2 {
+			if s.Intn(2) == 0 {
+				cfg.disconnect(leader)
+			} else {
+				cfg.crash1(leader)
+			}
+			nup -= 1
+		}
+
+		if nup < 3 {
+			i := s.Int() % servers
+			if cfg.rafts[i] == nil {
+				cfg.start1(i, cfg.applierSnap)
+			}
+			if cfg.connected[i] == false {
+				cfg.connect(i)
+				nup += 1
+			}
+		}
+	}
+
+	for i := 0; i < servers; i++ {
+		if cfg.rafts[i] == nil {
+			cfg.start1(i, cfg.applierSnap)
+		}
+		if cfg.connected[i] == false {
+			cfg.connect(i)
+		}
+	}
+
+	cfg.one(s.Int()%10000, servers, true)
+
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	out := fmt.Sprint(s.Now().Sub(cfg.start), cfg.rpcTotal(), cfg.bytesTotal(), cfg.logs)
+	for i := 0; i < servers; i++ {
+		term, leader := cfg.rafts[i].GetState()
+		out += fmt.Sprintf(" %v:%v:%v", i, term, leader)
+	}
+	return out
+}
+
+func TestSimFigure8(t *testing.T) {
+	runSim(t, func(s *labsim.Sim) {
+		fmt.Printf("Test: Figure 8 with crashes, simulated ...\n")
+		t0 := s.Now()
+		simFigure8(t, s, 500)
+		fmt.Printf("  ... Passed --  %v simulated\n", s.Since(t0).Round(time.Second))
+	})
+}
+
+// in a simulation, a ReadIndex deadline passes on the virtual clock.
+func TestSimReadIndexDeadline(t *testing.T) {
+	runSim(t, func(s *labsim.Sim) {
+		servers := 3
+		cfg := make_config_opts(t, servers, false, false, Options{Sim: s})
+		defer cfg.cleanup()
+
+		cfg.begin("Test: ReadIndex deadline, simulated")
+
+		cfg.one(101, servers, true)
+		leader := cfg.checkOneLeader()
+		cfg.disconnect((leader + 1) % servers)
+		cfg.disconnect((leader + 2) % servers)
+
+		ctx, cancel := context.WithTimeout(context.Background(), RaftElectionTimeout)
+		defer cancel()
+		t0 := s.Now()
+		if _, err := cfg.rafts[leader].ReadIndex(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("ReadIndex without a majority: %v, expected a deadline", err)
+		}
+		if d := s.Since(t0); d < RaftElectionTimeout/2 || d > 2*RaftElectionTimeout {
+			t.Fatalf("ReadIndex gave up after %v simulated; expected about %v", d, RaftElectionTimeout)
+		}
+
+		cfg.end()
+	})
+}
+
+// a seed replays exactly.
+func TestSimReplay(t *testing.T) {
+	fmt.Printf("Test: a simulation replays the same way ...\n")
+	run := func(seed int64) string {
+		out := ""
+		s := labsim.New(seed)
+		s.Run(func() { out = simFigure8(t, s, 100) })
+		return out
+	}
+	for seed := int64(1); seed <= 2; seed++ {
+		if a, b := run(seed), run(seed); a != b {
+			t.Fatalf("seed %v ran two ways:\n%v\n%v", seed, a, b)
+		}
+	}
+	if run(1) == run(2) {
+		t.Fatalf("seeds 1 and 2 ran the same way")
+	}
+	fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,106 @@
+package raft
+
+//
+// leadership transfer, e.g. to take the leader down for maintenance
+// without waiting for an election timeout.
+//
+// rf.TransferLeadership(target) error
+//   hand leadership over to peers[target].
+//
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrBadTransferTarget  = errors.New("raft: can't transfer leadership to that server")
+	ErrTransferInProgress = errors.New("raft: a leadership transfer is already in progress")
+	ErrTransferTimeout    = errors.New("raft: leadership transfer timed out")
+)
+
+type TimeoutNowArgs struct {
+	Term     int32
+	LeaderId int
+}
+
+type TimeoutNowReply struct {
+	Term int32
+}
+
+// TransferLeadership hands leadership over to target (an index into
+// peers[]), following section 3.10 of the Raft dissertation. the leader
+// stops accepting Start() calls, brings target's log up to date, and
+// sends it a TimeoutNow RPC, upon which target starts an election right
+// away, which it wins since its log is up to date.
+//
+// it returns nil once this server is no longer the leader. if that doesn't
+// happen within an election timeout, it gives up, starts accepting Start()
+// calls again and returns ErrTransferTimeout.
+func (rf *Raft) TransferLeadership(target int) error {
+	rf.mu.Lock()
+	if rf.raftState != Leader {
+		rf.mu.Unlock()
+		return ErrNotLeader
+	}
+	if target == rf.me || target < 0 || target >= len(rf.peers) || !rf.members[target] {
+		rf.mu.Unlock()
+		return ErrBadTransferTarget
+	}
+	if rf.transferTarget >= 0 {
+		rf.mu.Unlock()
+		return ErrTransferInProgress
+	}
+	rf.transferTarget = target
+	term := rf.currTerm
+	rf.mu.Unlock()
+
+	rf.logger.Log(0, "Transferring leadership from %v to %v", rf.me, target)
+
+	defer func() {
+		rf.mu.Lock()
+		if rf.currTerm == term {
+			rf.transferTarget = -1
+		}
+		rf.mu.Unlock()
+	}()
+
+	deadline := rf.sim.Now().Add(electionTimeoutMin * time.Millisecond)
+	sent := false
+	for !rf.killed() && rf.sim.Now().Before(deadline) {
+		rf.mu.Lock()
+		if rf.raftState != Leader || rf.currTerm != term {
+			rf.mu.Unlock()
+			return nil
+		}
+		caughtUp := rf.matchIndex[target] == rf.lastLogIndex()
+		if !caughtUp {
+			// the replicator is sending it entries; make sure we learn when it has them all
+			rf.sendEmpty(target, term)
+		}
+		rf.mu.Unlock()
+
+		if caughtUp && !sent {
+			args := &TimeoutNowArgs{Term: term, LeaderId: rf.me}
+			reply := &TimeoutNowReply{}
+			sent = rf.peers[target].Call("Raft.TimeoutNow", args, reply)
+		}
+		rf.sim.Sleep(20 * time.Millisecond)
+	}
+	return ErrTransferTimeout
+}
+
+// TimeoutNow is invoked by the leader to have me start an election
+// immediately, as if my election timer had fired.
+func (rf *Raft) TimeoutNow(args *TimeoutNowArgs, reply *TimeoutNowReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	reply.Term = rf.currTerm
+	if args.Term < rf.currTerm || !rf.members[rf.me] {
+		return
+	}
+
+	rf.logger.Log(0, "Leader %v asked %v to take over", args.LeaderId, rf.me)
+	rf.sim.Go(func() { rf.startElection(true) })
+}